@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ACL decides which clients a listener answers. Deny wins over allow, and
+// an empty allow list allows every client which isn't denied.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL parses allow and deny lists of addresses and CIDR networks. It
+// returns nil, which allows everybody, if both lists are empty.
+func NewACL(allow, deny []string) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	a := &ACL{}
+	var err error
+	if a.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseNets(ss []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Allowed tells whether ip may query. A nil ACL allows everybody.
+func (a *ACL) Allowed(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler wraps next so that the queries of clients which aren't allowed
+// are refused.
+func (a *ACL) Handler(next dns.HandlerFunc) dns.Handler {
+	if a == nil {
+		return next
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if ip := remoteIP(w.RemoteAddr()); !a.Allowed(ip) {
+			logger.Debug("%s refused", ip)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		next(w, req)
+	})
+}
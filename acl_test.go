@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestACL(t *testing.T) {
+	Convey("ACLs allow and deny clients by address", t, func() {
+		acl, err := NewACL([]string{"192.168.1.0/24", "10.0.0.1", "fd00::/8"}, []string{"192.168.1.13"})
+		So(err, ShouldBeNil)
+
+		for ip, allowed := range map[string]bool{
+			"192.168.1.1":  true,
+			"192.168.1.13": false,
+			"192.168.2.1":  false,
+			"10.0.0.1":     true,
+			"10.0.0.2":     false,
+			"fd00::1":      true,
+			"2001:db8::1":  false,
+		} {
+			So(acl.Allowed(net.ParseIP(ip)), ShouldEqual, allowed)
+		}
+		So(acl.Allowed(nil), ShouldBeFalse)
+
+		acl, err = NewACL(nil, []string{"172.17.0.0/16"})
+		So(err, ShouldBeNil)
+		So(acl.Allowed(net.ParseIP("172.17.0.2")), ShouldBeFalse)
+		So(acl.Allowed(net.ParseIP("192.168.1.1")), ShouldBeTrue)
+
+		acl, err = NewACL(nil, nil)
+		So(err, ShouldBeNil)
+		So(acl, ShouldBeNil)
+		So(acl.Allowed(net.ParseIP("192.168.1.1")), ShouldBeTrue)
+
+		_, err = NewACL([]string{"192.168.1.0/33"}, nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewACL(nil, []string{"localhost"})
+		So(err, ShouldNotBeNil)
+	})
+}
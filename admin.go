@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// AdminServer serves operator endpoints over HTTP, such as the cache stats.
+// It should only listen on a trusted address.
+type AdminServer struct {
+	listen  string
+	handler *GODNSHandler
+}
+
+// httpServer returns the HTTP server of the admin endpoints.
+func (a *AdminServer) httpServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", a.stats)
+	mux.HandleFunc("/cache/flush", a.flush)
+	mux.HandleFunc("/cache/dump", a.dump)
+	mux.HandleFunc("/upstreams", a.upstreams)
+	return &http.Server{Addr: a.listen, Handler: mux}
+}
+
+// stats reports the stats of every cache by name.
+func (a *AdminServer) stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.handler.Stats())
+}
+
+// upstreams reports the health of every upstream.
+func (a *AdminServer) upstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.handler.resolver.UpstreamStatus())
+}
+
+// flush drops cache entries, selected by the all, name and type or suffix
+// query parameters.
+func (a *AdminServer) flush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "flush needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	p, err := ParsePurgeQuery(q.Get("all") != "", q.Get("name"), q.Get("type"), q.Get("suffix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := a.handler.Flush(p)
+	removed := fmt.Sprintf("removed %d entries", n)
+	if n < 0 {
+		removed = "removed an unknown number of entries"
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s, but %s", removed, err), http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{"purge": p.String()}
+	if n >= 0 {
+		res["removed"] = n
+	}
+	writeJSON(w, res)
+}
+
+// dump lists the cached entries, all of them or those selected by the name
+// and type or suffix query parameters, as text or with format=json.
+func (a *AdminServer) dump(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := Purge{}
+	if q.Get("name") != "" || q.Get("suffix") != "" {
+		var err error
+		if p, err = ParsePurgeQuery(false, q.Get("name"), q.Get("type"), q.Get("suffix")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := q.Get("format")
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if err := WriteDump(w, a.handler.Dump(p), format); err != nil {
+		logger.Warn("Write admin response failed: %s", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logger.Warn("Write admin response failed: %s", err)
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"crypto/md5"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
@@ -43,61 +44,247 @@ func (e SerializerError) Error() string {
 
 type Msg struct {
 	Msg    *dns.Msg
+	Stored time.Time
 	Expire time.Time
+	Hits   atomic.Uint64
 }
 
 type Cache interface {
-	Get(key string) (Msg *dns.Msg, err error)
-	Set(key string, Msg *dns.Msg) error
-	Exists(key string) bool
-	Remove(key string) error
+	Get(key CacheKey) (Msg *dns.Msg, err error)
+	Set(key CacheKey, Msg *dns.Msg) error
+	Exists(key CacheKey) bool
+	Remove(key CacheKey) error
 	Full() bool
+	Stats() CacheStats
+	// Purge drops the entries selected by p and returns their number,
+	// or -1 if the backend can't count them.
+	Purge(p Purge) (int, error)
 }
 
+// Prefetcher is implemented by caches which track how popular their
+// entries are, to refresh the popular ones shortly before they expire.
+type Prefetcher interface {
+	NeedPrefetch(key CacheKey) bool
+}
+
+// StaleCache is implemented by caches which keep expired entries for a
+// while, so they can be served when no upstream answers (RFC 8767).
+type StaleCache interface {
+	// GetStale returns a copy of the entry for key, expired or not,
+	// as long as it is within the stale window.
+	GetStale(key CacheKey) (Msg *dns.Msg, err error)
+}
+
+// MemoryCache keeps each message for the minimum TTL of its records,
+// clamped to [MinTTL, MaxTTL]. Expire is used for messages which carry
+// no records to derive a TTL from. Once MaxCount entries are stored,
+// the eviction policy makes room for new ones. Expired entries are kept
+// for another Stale duration to be served by GetStale. Entries hit at least
+// PrefetchHits times need a prefetch in the last Prefetch fraction of
+// their lifetime.
 type MemoryCache struct {
-	Backend  map[string]Msg
-	Expire   time.Duration
-	MaxCount int
-	mu       sync.RWMutex
+	Backend      map[CacheKey]*Msg
+	Expire       time.Duration
+	MinTTL       time.Duration
+	MaxTTL       time.Duration
+	Stale        time.Duration
+	Prefetch     float64
+	PrefetchHits uint64
+	MaxCount     int
+	mu           sync.RWMutex
+	policy       evictionPolicy
+	sweeping     bool
+	counters     cacheCounters
 }
 
-func (c *MemoryCache) Get(key string) (*dns.Msg, error) {
+func NewMemoryCache(cc CacheConf) *MemoryCache {
+	policy, ok := newEvictionPolicy(cc.Eviction)
+	if !ok {
+		logger.Error("Invalid cache eviction policy %s", cc.Eviction)
+		panic("Invalid cache eviction policy")
+	}
+
+	c := &MemoryCache{
+		Backend:      make(map[CacheKey]*Msg, cc.MaxCount),
+		Expire:       time.Duration(cc.Expire) * time.Second,
+		MinTTL:       time.Duration(cc.MinTTL) * time.Second,
+		MaxTTL:       time.Duration(cc.MaxTTL) * time.Second,
+		Stale:        time.Duration(cc.StaleTTL) * time.Second,
+		Prefetch:     float64(cc.Prefetch) / 100,
+		PrefetchHits: uint64(cc.PrefetchHits),
+		MaxCount:     cc.MaxCount,
+		policy:       policy,
+	}
+
+	if cc.Sweep > 0 {
+		c.sweeping = true
+		go sweep(time.Duration(cc.Sweep)*time.Second, c)
+	}
+	return c
+}
+
+// Get returns a copy of the cached message whose TTLs count down
+// with the time it has spent in the cache.
+func (c *MemoryCache) Get(key CacheKey) (*dns.Msg, error) {
 	c.mu.RLock()
 	msg, ok := c.Backend[key]
 	c.mu.RUnlock()
 	if !ok {
-		return nil, KeyNotFound{key}
+		c.counters.misses.Add(1)
+		return nil, KeyNotFound{key.String()}
 	}
 
-	if msg.Expire.Before(time.Now()) {
-		c.Remove(key)
-		return nil, KeyExpired{key}
+	now := time.Now()
+	if msg.Expire.Before(now) {
+		c.counters.misses.Add(1)
+		// leave it to the sweeper rather than contend for the write lock
+		if !c.sweeping && msg.Expire.Add(c.Stale).Before(now) {
+			c.Remove(key)
+			c.counters.expirations.Add(1)
+		}
+		return nil, KeyExpired{key.String()}
 	}
 
-	return msg.Msg, nil
+	c.counters.hits.Add(1)
+	msg.Hits.Add(1)
+	if c.policy != nil {
+		c.policy.Touch(key)
+	}
+	return ageMsg(msg.Msg, now.Sub(msg.Stored), msg.Expire.Sub(now)), nil
 }
 
-func (c *MemoryCache) Set(key string, msg *dns.Msg) error {
-	if c.Full() && !c.Exists(key) {
-		return CacheIsFull{}
+// GetStale returns a copy of the cached message even if it has expired,
+// as long as it expired less than Stale ago. TTLs of expired messages are 0.
+func (c *MemoryCache) GetStale(key CacheKey) (*dns.Msg, error) {
+	c.mu.RLock()
+	msg, ok := c.Backend[key]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, KeyNotFound{key.String()}
+	}
+
+	now := time.Now()
+	if msg.Expire.Add(c.Stale).Before(now) {
+		return nil, KeyExpired{key.String()}
+	}
+	c.counters.staleHits.Add(1)
+	return ageMsg(msg.Msg, now.Sub(msg.Stored), msg.Expire.Sub(now)), nil
+}
+
+// NeedPrefetch reports whether key has been hit often enough and is close
+// enough to its expiry to be refreshed ahead of time.
+func (c *MemoryCache) NeedPrefetch(key CacheKey) bool {
+	if c.Prefetch <= 0 {
+		return false
+	}
+
+	c.mu.RLock()
+	msg, ok := c.Backend[key]
+	c.mu.RUnlock()
+	if !ok || msg.Hits.Load() < c.PrefetchHits {
+		return false
+	}
+
+	lifetime := msg.Expire.Sub(msg.Stored)
+	remaining := time.Until(msg.Expire)
+	return remaining > 0 && float64(remaining) <= float64(lifetime)*c.Prefetch
+}
+
+func (c *MemoryCache) Set(key CacheKey, msg *dns.Msg) error {
+	now := time.Now()
+	lifetime := c.Expire
+	if msg != nil {
+		if ttl, ok := msgTTL(msg); ok {
+			lifetime = clampDuration(time.Duration(ttl)*time.Second, c.MinTTL, c.MaxTTL)
+		}
+		msg = clampTTL(msg, c.MinTTL, c.MaxTTL)
 	}
+	m := &Msg{Msg: msg, Stored: now, Expire: now.Add(lifetime)}
 
-	expire := time.Now().Add(c.Expire)
-	m := Msg{msg, expire}
 	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.Backend[key]; !ok && c.full() && !c.evict() {
+		return CacheIsFull{}
+	}
 	c.Backend[key] = m
-	c.mu.Unlock()
+	if c.policy != nil {
+		c.policy.Add(key)
+	}
 	return nil
 }
 
-func (c *MemoryCache) Remove(key string) error {
+// Snapshot returns the entries which haven't left their stale window yet.
+func (c *MemoryCache) Snapshot() []SnapshotEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	entries := make([]SnapshotEntry, 0, len(c.Backend))
+	for key, msg := range c.Backend {
+		if msg.Expire.Add(c.Stale).Before(now) {
+			continue
+		}
+		e, err := newSnapshotEntry(key, msg)
+		if err != nil {
+			logger.Warn("Snapshot %s failed: %s", key, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Restore loads entries saved by Snapshot, skipping those which have left
+// their stale window since. It returns the number of restored entries.
+func (c *MemoryCache) Restore(entries []SnapshotEntry) int {
 	c.mu.Lock()
-	delete(c.Backend, key)
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for _, e := range entries {
+		if e.Expire.Add(c.Stale).Before(now) {
+			continue
+		}
+		msg, err := e.msg()
+		if err != nil {
+			logger.Warn("Restore %s failed: %s", e.Key, err)
+			continue
+		}
+		if _, ok := c.Backend[e.Key]; !ok && c.full() && !c.evict() {
+			break
+		}
+		c.Backend[e.Key] = msg
+		if c.policy != nil {
+			c.policy.Add(e.Key)
+		}
+		n++
+	}
+	return n
+}
+
+// Purge drops the entries selected by p and returns their number.
+func (c *MemoryCache) Purge(p Purge) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key := range c.Backend {
+		if p.match(key) {
+			c.remove(key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (c *MemoryCache) Remove(key CacheKey) error {
+	c.mu.Lock()
+	c.remove(key)
 	c.mu.Unlock()
 	return nil
 }
 
-func (c *MemoryCache) Exists(key string) bool {
+func (c *MemoryCache) Exists(key CacheKey) bool {
 	c.mu.RLock()
 	_, ok := c.Backend[key]
 	c.mu.RUnlock()
@@ -111,68 +298,150 @@ func (c *MemoryCache) Length() int {
 }
 
 func (c *MemoryCache) Full() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.full()
+}
+
+func (c *MemoryCache) full() bool {
 	// if MaxCount is zero. the cache will never be full.
 	if c.MaxCount == 0 {
 		return false
 	}
-	return c.Length() >= c.MaxCount
+	return len(c.Backend) >= c.MaxCount
+}
+
+// remove deletes key, the caller must hold the write lock.
+func (c *MemoryCache) remove(key CacheKey) {
+	delete(c.Backend, key)
+	if c.policy != nil {
+		c.policy.Remove(key)
+	}
+}
+
+// evict drops the entry chosen by the eviction policy, the caller must hold
+// the write lock. It returns false if there is no policy to ask.
+func (c *MemoryCache) evict() bool {
+	if c.policy == nil {
+		return false
+	}
+	key, ok := c.policy.Victim()
+	if !ok {
+		return false
+	}
+	c.remove(key)
+	c.counters.evictions.Add(1)
+	return true
+}
+
+// sweep periodically removes entries past their stale window from caches, so
+// they don't linger until they are asked for again.
+func sweep(interval time.Duration, caches ...*MemoryCache) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, now := 0, time.Now()
+		for _, c := range caches {
+			n += c.removeExpired(now)
+		}
+		if n > 0 {
+			logger.Debug("Swept %d expired cache entries", n)
+		}
+	}
+}
+
+func (c *MemoryCache) removeExpired(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, msg := range c.Backend {
+		if msg.Expire.Add(c.Stale).Before(now) {
+			c.remove(key)
+			n++
+		}
+	}
+	c.counters.expirations.Add(uint64(n))
+	return n
+}
+
+func (c *MemoryCache) Stats() CacheStats {
+	return c.counters.stats(int64(c.Length()))
 }
 
 // Memcached backend
 
-func NewMemcachedCache(servers []string, expire int32) *MemcachedCache {
+// NewMemcachedCache keeps entries without records for cc.Expire seconds
+// and clamps the others to cc.MinTTL and cc.MaxTTL.
+func NewMemcachedCache(servers []string, cc CacheConf, prefix string) *MemcachedCache {
 	c := memcache.New(servers...)
 	return &MemcachedCache{
-		backend: c,
-		expire:  expire,
+		backend:   c,
+		expire:    int32(cc.Expire),
+		prefix:    prefix,
+		ttlBounds: newTTLBounds(cc),
 	}
 }
 
+// MemcachedCache stores its entries under prefix followed by the readable
+// cache key, or its hash if that doesn't fit into a memcache key.
 type MemcachedCache struct {
-	backend *memcache.Client
-	expire  int32
+	backend  *memcache.Client
+	expire   int32
+	prefix   string
+	counters cacheCounters
+	ttlBounds
 }
 
-func (m *MemcachedCache) Set(key string, msg *dns.Msg) error {
-	var val []byte
-	var err error
+func (m *MemcachedCache) key(key CacheKey) string {
+	k := m.prefix + key.String()
+	if len(k) > 250 || strings.ContainsAny(k, " \t\r\n") {
+		k = fmt.Sprintf("%s%08x", m.prefix, key.hash())
+	}
+	return k
+}
 
-	// handle cases for negacache where it sets nil values
-	if msg == nil {
-		val = []byte("nil")
-	} else {
-		val, err = msg.Pack()
+func (m *MemcachedCache) Set(key CacheKey, msg *dns.Msg) error {
+	ttl := m.remoteTTL(msg, int64(m.expire))
+	if ttl == 0 {
+		// memcache would keep an entry without expiration forever
+		return nil
+	}
+	if msg != nil {
+		msg = clampTTL(msg, m.minTTL, m.maxTTL)
 	}
+
+	val, err := packEnvelope(msg, ttl, time.Now())
 	if err != nil {
-		err = SerializerError{err}
+		return err
 	}
-	return m.backend.Set(&memcache.Item{Key: key, Value: val, Expiration: m.expire})
+	return m.backend.Set(&memcache.Item{Key: m.key(key), Value: val, Expiration: int32(ttl)})
 }
 
-func (m *MemcachedCache) Get(key string) (*dns.Msg, error) {
-	var msg dns.Msg
-	item, err := m.backend.Get(key)
+// Get returns the cached message with its TTLs counted down, or nil
+// for entries of the failure cache.
+func (m *MemcachedCache) Get(key CacheKey) (*dns.Msg, error) {
+	item, err := m.backend.Get(m.key(key))
 	if err != nil {
-		err = KeyNotFound{key}
-		return &msg, err
+		m.counters.misses.Add(1)
+		return nil, KeyNotFound{key.String()}
 	}
-	err = msg.Unpack(item.Value)
+
+	msg, err := unpackEnvelope(item.Value, time.Now())
 	if err != nil {
-		err = SerializerError{err}
+		m.counters.misses.Add(1)
+		return nil, err
 	}
-	return &msg, err
+	m.counters.hits.Add(1)
+	return msg, nil
 }
 
-func (m *MemcachedCache) Exists(key string) bool {
-	_, err := m.backend.Get(key)
-	if err != nil {
-		return true
-	}
-	return false
+func (m *MemcachedCache) Exists(key CacheKey) bool {
+	_, err := m.backend.Get(m.key(key))
+	return err == nil
 }
 
-func (m *MemcachedCache) Remove(key string) error {
-	return m.backend.Delete(key)
+func (m *MemcachedCache) Remove(key CacheKey) error {
+	return m.backend.Delete(m.key(key))
 }
 
 func (m *MemcachedCache) Full() bool {
@@ -180,61 +449,120 @@ func (m *MemcachedCache) Full() bool {
 	return false
 }
 
+// Purge can only drop the entries it can compute the keys of: a name with
+// a type, or with every known type, except for variants keyed by client
+// subnet, or every entry. The latter flushes the whole memcached, including
+// data of other applications.
+func (m *MemcachedCache) Purge(p Purge) (int, error) {
+	switch {
+	case p.Name == "":
+		return -1, m.backend.FlushAll()
+	case p.Suffix:
+		return 0, errPurgeUnsupported
+	}
+
+	qtypes := []uint16{p.Qtype}
+	if p.Qtype == 0 {
+		qtypes = qtypes[:0]
+		for qtype := range dns.TypeToString {
+			qtypes = append(qtypes, qtype)
+		}
+	}
+
+	n := 0
+	for _, qtype := range qtypes {
+		for _, do := range []bool{false, true} {
+			for _, cd := range []bool{false, true} {
+				key := CacheKey{Name: p.Name, Qtype: qtype, Qclass: dns.ClassINET, DO: do, CD: cd}
+				switch err := m.backend.Delete(m.key(key)); err {
+				case nil:
+					n++
+				case memcache.ErrCacheMiss:
+				default:
+					return n, err
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+// Stats counts hits and misses seen by this process, memcache evicts
+// and expires entries on its own.
+func (m *MemcachedCache) Stats() CacheStats {
+	return m.counters.stats(-1)
+}
+
 // Redis cache Backend
 
-func NewRedisCache(rs RedisConf, expire int64) *RedisCache {
+// NewRedisCache keeps entries without records for cc.Expire seconds and
+// clamps the others to cc.MinTTL and cc.MaxTTL.
+func NewRedisCache(rs RedisConf, cc CacheConf, prefix string) *RedisCache {
 	rc := &redis.Client{Addr: rs.Addr(), Db: rs.DB, Password: rs.Password}
 	return &RedisCache{
-		Backend: rc,
-		Expire:  expire,
+		Backend:   rc,
+		Expire:    int64(cc.Expire),
+		Prefix:    prefix,
+		ttlBounds: newTTLBounds(cc),
 	}
 }
 
+// RedisCache stores its entries under Prefix followed by the readable
+// cache key, e.g. "godns:cache:www.example.com.:IN:A".
 type RedisCache struct {
-	Backend *redis.Client
-	Expire  int64
+	Backend  *redis.Client
+	Expire   int64
+	Prefix   string
+	counters cacheCounters
+	ttlBounds
+}
+
+func (r *RedisCache) key(key CacheKey) string {
+	return r.Prefix + key.String()
 }
 
-func (r *RedisCache) Get(key string) (*dns.Msg, error) {
-	var msg dns.Msg
-	item, err := r.Backend.Get(key)
+// Get returns the cached message with its TTLs counted down, or nil
+// for entries of the failure cache.
+func (r *RedisCache) Get(key CacheKey) (*dns.Msg, error) {
+	item, err := r.Backend.Get(r.key(key))
 	if err != nil {
-		err = KeyNotFound{key}
-		return &msg, err
+		r.counters.misses.Add(1)
+		return nil, KeyNotFound{key.String()}
 	}
-	err = msg.Unpack(item)
+
+	msg, err := unpackEnvelope(item, time.Now())
 	if err != nil {
-		err = SerializerError{err}
+		r.counters.misses.Add(1)
+		return nil, err
 	}
-	return &msg, err
+	r.counters.hits.Add(1)
+	return msg, nil
 }
 
-func (r *RedisCache) Set(key string, msg *dns.Msg) error {
-	var val []byte
-	var err error
-
-	// handle cases for negacache where it sets nil values
-	if msg == nil {
-		val = []byte("nil")
-	} else {
-		val, err = msg.Pack()
+func (r *RedisCache) Set(key CacheKey, msg *dns.Msg) error {
+	ttl := r.remoteTTL(msg, r.Expire)
+	if ttl == 0 {
+		// SETEX refuses a zero expiry
+		return nil
 	}
-	if err != nil {
-		err = SerializerError{err}
+	if msg != nil {
+		msg = clampTTL(msg, r.minTTL, r.maxTTL)
 	}
-	return r.Backend.Setex(key, r.Expire, val)
-}
 
-func (r *RedisCache) Exists(key string) bool {
-	_, err := r.Backend.Get(key)
+	val, err := packEnvelope(msg, ttl, time.Now())
 	if err != nil {
-		return true
+		return err
 	}
-	return false
+	return r.Backend.Setex(r.key(key), int64(ttl), val)
 }
 
-func (r *RedisCache) Remove(key string) error {
-	_, err := r.Backend.Del(key)
+func (r *RedisCache) Exists(key CacheKey) bool {
+	ok, err := r.Backend.Exists(r.key(key))
+	return err == nil && ok
+}
+
+func (r *RedisCache) Remove(key CacheKey) error {
+	_, err := r.Backend.Del(r.key(key))
 	return err
 }
 
@@ -242,10 +570,155 @@ func (r *RedisCache) Full() bool {
 	return false
 }
 
-func KeyGen(q Question) string {
-	h := md5.New()
-	h.Write([]byte(q.String()))
-	x := h.Sum(nil)
-	key := fmt.Sprintf("%x", x)
-	return key
+// Purge looks the selected entries up with KEYS, which blocks redis while
+// it scans the database. It is meant for occasional use by operators.
+func (r *RedisCache) Purge(p Purge) (int, error) {
+	var patterns []string
+	switch {
+	case p.Name == "":
+		patterns = []string{r.Prefix + "*"}
+	case p.Suffix:
+		patterns = []string{r.Prefix + globEscape(p.Name) + ":*", r.Prefix + "*" + globEscape("."+p.Name) + ":*"}
+	default:
+		patterns = []string{r.Prefix + globEscape(p.Name) + ":*"}
+	}
+
+	n := 0
+	for _, pattern := range patterns {
+		keys, err := r.Backend.Keys(pattern)
+		if err != nil {
+			return n, err
+		}
+		for _, k := range keys {
+			if p.Qtype != 0 && !keyHasType(strings.TrimPrefix(k, r.Prefix+p.Name), p.Qtype) {
+				continue
+			}
+			ok, err := r.Backend.Del(k)
+			if err != nil {
+				return n, err
+			}
+			if ok {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// keyHasType reports whether the rest of a key after its name,
+// ":CLASS:TYPE[:flags]", has the type t.
+func keyHasType(rest string, t uint16) bool {
+	parts := strings.SplitN(strings.TrimPrefix(rest, ":"), ":", 3)
+	return len(parts) >= 2 && parts[1] == typeString(t)
+}
+
+// globEscape escapes the characters redis KEYS patterns treat specially.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Stats counts hits and misses seen by this process, redis expires
+// entries on its own and shares its database with other instances.
+func (r *RedisCache) Stats() CacheStats {
+	return r.counters.stats(-1)
+}
+
+// msgTTL returns the minimum TTL across the answer and authority sections.
+// For negative answers the SOA minimum field bounds it too (RFC 2308).
+// It reports false if both sections are empty.
+func msgTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range rrs {
+			if t := rr.Header().Ttl; !ok || t < ttl {
+				ttl, ok = t, true
+			}
+		}
+	}
+	if len(m.Answer) == 0 {
+		if soa := negativeSOA(m); soa != nil && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	return ttl, ok
+}
+
+// negativeSOA returns the SOA record from the authority section, if any.
+func negativeSOA(m *dns.Msg) *dns.SOA {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// clampTTL returns a copy of m with every record TTL raised to min and
+// lowered to max. A zero bound is ignored.
+func clampTTL(m *dns.Msg, min, max time.Duration) *dns.Msg {
+	m = m.Copy()
+	lo, hi := uint32(min/time.Second), uint32(max/time.Second)
+	forEachTTL(m, func(h *dns.RR_Header) {
+		if lo > 0 && h.Ttl < lo {
+			h.Ttl = lo
+		}
+		if hi > 0 && h.Ttl > hi {
+			h.Ttl = hi
+		}
+	})
+	return m
+}
+
+// clampDuration raises d to min and lowers it to max. A zero bound is ignored.
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if min > 0 && d < min {
+		d = min
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// ageMsg returns a copy of m with every record TTL decreased by age
+// and capped to the remaining lifetime of the cache entry.
+func ageMsg(m *dns.Msg, age, remaining time.Duration) *dns.Msg {
+	if m == nil {
+		return nil
+	}
+	m = m.Copy()
+	elapsed := uint32(age / time.Second)
+	left := uint32(0)
+	if remaining > 0 {
+		left = uint32((remaining + time.Second - 1) / time.Second)
+	}
+	forEachTTL(m, func(h *dns.RR_Header) {
+		if h.Ttl > elapsed {
+			h.Ttl -= elapsed
+		} else {
+			h.Ttl = 0
+		}
+		if h.Ttl > left {
+			h.Ttl = left
+		}
+	})
+	return m
+}
+
+// forEachTTL calls fn with the header of every record in m, skipping
+// the OPT pseudo record whose TTL field carries EDNS flags.
+func forEachTTL(m *dns.Msg, fn func(h *dns.RR_Header)) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				fn(h)
+			}
+		}
+	}
 }
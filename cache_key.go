@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CacheKey identifies a cached answer. Besides the question it holds the
+// request attributes which change the answer upstream gives: the DNSSEC OK
+// bit, the checking disabled flag and the EDNS client subnet.
+type CacheKey struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+	CD     bool
+	ECS    string
+}
+
+// NewCacheKey returns the cache key for the first question of req.
+func NewCacheKey(req *dns.Msg) CacheKey {
+	q := req.Question[0]
+	k := CacheKey{
+		Name:   strings.ToLower(dns.Fqdn(q.Name)),
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+		CD:     req.CheckingDisabled,
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		k.DO = opt.Do()
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				k.ECS = ecs.Address.String() + "/" + strconv.Itoa(int(ecs.SourceNetmask))
+			}
+		}
+	}
+	return k
+}
+
+// String returns the readable form of the key used by the remote cache
+// backends, e.g. "www.example.com.:IN:A:do:ecs=192.0.2.0/24".
+func (k CacheKey) String() string {
+	var b strings.Builder
+	b.WriteString(k.Name)
+	b.WriteByte(':')
+	b.WriteString(classString(k.Qclass))
+	b.WriteByte(':')
+	b.WriteString(typeString(k.Qtype))
+	if k.DO {
+		b.WriteString(":do")
+	}
+	if k.CD {
+		b.WriteString(":cd")
+	}
+	if k.ECS != "" {
+		b.WriteString(":ecs=")
+		b.WriteString(k.ECS)
+	}
+	return b.String()
+}
+
+// hash returns the FNV-1a hash of the key, cheap enough to pick a shard
+// on every query.
+func (k CacheKey) hash() uint32 {
+	h := uint32(2166136261)
+	add := func(b byte) {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	for i := 0; i < len(k.Name); i++ {
+		add(k.Name[i])
+	}
+	add(byte(k.Qtype >> 8))
+	add(byte(k.Qtype))
+	add(byte(k.Qclass >> 8))
+	add(byte(k.Qclass))
+	if k.DO {
+		add(1)
+	}
+	if k.CD {
+		add(2)
+	}
+	for i := 0; i < len(k.ECS); i++ {
+		add(k.ECS[i])
+	}
+	return h
+}
+
+func typeString(t uint16) string {
+	if s, ok := dns.TypeToString[t]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+func classString(c uint16) string {
+	if s, ok := dns.ClassToString[c]; ok {
+		return s
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
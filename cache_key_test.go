@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCacheKey(t *testing.T) {
+	Convey("Cache keys tell apart answers which differ upstream", t, func() {
+		req := new(dns.Msg)
+		req.SetQuestion("WWW.Example.com.", dns.TypeA)
+		plain := NewCacheKey(req)
+		So(plain, ShouldResemble, CacheKey{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		So(plain.String(), ShouldEqual, "www.example.com.:IN:A")
+
+		Convey("by the DNSSEC OK bit and checking disabled flag", func() {
+			req.SetEdns0(4096, true)
+			req.CheckingDisabled = true
+			k := NewCacheKey(req)
+			So(k, ShouldNotResemble, plain)
+			So(k.String(), ShouldEqual, "www.example.com.:IN:A:do:cd")
+		})
+
+		Convey("by the EDNS client subnet", func() {
+			req.SetEdns0(4096, false)
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP("192.0.2.0").To4(),
+			})
+			k := NewCacheKey(req)
+			So(k.ECS, ShouldEqual, "192.0.2.0/24")
+			So(k.String(), ShouldEqual, "www.example.com.:IN:A:ecs=192.0.2.0/24")
+			So(k.hash(), ShouldNotEqual, plain.hash())
+		})
+
+		Convey("by the query type", func() {
+			req.Question[0].Qtype = dns.TypeAAAA
+			So(NewCacheKey(req).String(), ShouldEqual, "www.example.com.:IN:AAAA")
+		})
+	})
+}
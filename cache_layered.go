@@ -0,0 +1,98 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// LayeredCache puts a small in-process L1 cache in front of a shared remote
+// L2 cache. Hits in L2 populate L1, writes go to both.
+type LayeredCache struct {
+	L1, L2 Cache
+}
+
+func NewLayeredCache(l1, l2 Cache) *LayeredCache {
+	return &LayeredCache{L1: l1, L2: l2}
+}
+
+func (c *LayeredCache) Get(key CacheKey) (*dns.Msg, error) {
+	if msg, err := c.L1.Get(key); err == nil {
+		return msg, nil
+	}
+
+	msg, err := c.L2.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	// L2 hands out the TTLs counted down, so L1 keeps it no longer than L2
+	if err := c.L1.Set(key, msg); err != nil {
+		logger.Warn("Set %s L1 cache failed: %s", key, err)
+	}
+	return msg, nil
+}
+
+func (c *LayeredCache) Set(key CacheKey, msg *dns.Msg) error {
+	if err := c.L1.Set(key, msg); err != nil {
+		logger.Warn("Set %s L1 cache failed: %s", key, err)
+	}
+	return c.L2.Set(key, msg)
+}
+
+func (c *LayeredCache) Exists(key CacheKey) bool {
+	return c.L1.Exists(key) || c.L2.Exists(key)
+}
+
+func (c *LayeredCache) Remove(key CacheKey) error {
+	c.L1.Remove(key)
+	return c.L2.Remove(key)
+}
+
+func (c *LayeredCache) Full() bool {
+	return c.L2.Full()
+}
+
+// Stats counts hits in either layer, misses of L2 and the evictions,
+// expirations and size of L1.
+func (c *LayeredCache) Stats() CacheStats {
+	l1, l2 := c.L1.Stats(), c.L2.Stats()
+	l1.Hits += l2.Hits
+	l1.Misses = l2.Misses
+	return l1
+}
+
+// GetStale serves stale answers from L1, the remote backends drop
+// entries on expiry.
+func (c *LayeredCache) GetStale(key CacheKey) (*dns.Msg, error) {
+	if sc, ok := c.L1.(StaleCache); ok {
+		return sc.GetStale(key)
+	}
+	return nil, KeyNotFound{key.String()}
+}
+
+func (c *LayeredCache) NeedPrefetch(key CacheKey) bool {
+	p, ok := c.L1.(Prefetcher)
+	return ok && p.NeedPrefetch(key)
+}
+
+// Purge drops the entries selected by p from both layers. Their number is
+// unknown, -1, if L2 can't count them.
+func (c *LayeredCache) Purge(p Purge) (int, error) {
+	n, _ := c.L1.Purge(p)
+	m, err := c.L2.Purge(p)
+	if m < 0 {
+		return -1, err
+	}
+	return n + m, err
+}
+
+// localCache returns the part of c which lives in this process: L1 of a
+// layered cache, c itself for memory caches and nil for remote ones.
+func localCache(c Cache) Cache {
+	switch c := c.(type) {
+	case *LayeredCache:
+		return c.L1
+	case *MemoryCache, *ShardedMemoryCache:
+		return c
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ShardedMemoryCache spreads its entries over several MemoryCache shards,
+// picked by a hash of the key, so concurrent queries rarely contend on
+// the same lock. MaxCount is split evenly between the shards, which share
+// one sweeper.
+type ShardedMemoryCache struct {
+	shards []*MemoryCache
+}
+
+func NewShardedMemoryCache(cc CacheConf) *ShardedMemoryCache {
+	n := cc.Shards
+	if n < 1 {
+		n = 1
+	}
+
+	shardConf := cc
+	shardConf.Sweep = 0
+	if cc.MaxCount > 0 {
+		shardConf.MaxCount = (cc.MaxCount + n - 1) / n
+	}
+
+	c := &ShardedMemoryCache{shards: make([]*MemoryCache, n)}
+	for i := range c.shards {
+		c.shards[i] = NewMemoryCache(shardConf)
+		c.shards[i].sweeping = cc.Sweep > 0
+	}
+	if cc.Sweep > 0 {
+		go sweep(time.Duration(cc.Sweep)*time.Second, c.shards...)
+	}
+	return c
+}
+
+// shard returns the shard owning key, chosen by its hash.
+func (c *ShardedMemoryCache) shard(key CacheKey) *MemoryCache {
+	return c.shards[key.hash()%uint32(len(c.shards))]
+}
+
+func (c *ShardedMemoryCache) Get(key CacheKey) (*dns.Msg, error) {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedMemoryCache) GetStale(key CacheKey) (*dns.Msg, error) {
+	return c.shard(key).GetStale(key)
+}
+
+func (c *ShardedMemoryCache) NeedPrefetch(key CacheKey) bool {
+	return c.shard(key).NeedPrefetch(key)
+}
+
+func (c *ShardedMemoryCache) Set(key CacheKey, msg *dns.Msg) error {
+	return c.shard(key).Set(key, msg)
+}
+
+func (c *ShardedMemoryCache) Exists(key CacheKey) bool {
+	return c.shard(key).Exists(key)
+}
+
+func (c *ShardedMemoryCache) Remove(key CacheKey) error {
+	return c.shard(key).Remove(key)
+}
+
+func (c *ShardedMemoryCache) Snapshot() []SnapshotEntry {
+	var entries []SnapshotEntry
+	for _, s := range c.shards {
+		entries = append(entries, s.Snapshot()...)
+	}
+	return entries
+}
+
+func (c *ShardedMemoryCache) Restore(entries []SnapshotEntry) int {
+	byShard := make(map[*MemoryCache][]SnapshotEntry, len(c.shards))
+	for _, e := range entries {
+		s := c.shard(e.Key)
+		byShard[s] = append(byShard[s], e)
+	}
+
+	n := 0
+	for s, es := range byShard {
+		n += s.Restore(es)
+	}
+	return n
+}
+
+func (c *ShardedMemoryCache) Purge(p Purge) (int, error) {
+	n := 0
+	for _, s := range c.shards {
+		m, _ := s.Purge(p)
+		n += m
+	}
+	return n, nil
+}
+
+func (c *ShardedMemoryCache) Length() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Length()
+	}
+	return n
+}
+
+// Full reports whether every shard is full.
+func (c *ShardedMemoryCache) Full() bool {
+	for _, s := range c.shards {
+		if !s.Full() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *ShardedMemoryCache) Stats() CacheStats {
+	var stats CacheStats
+	for _, s := range c.shards {
+		stats = stats.add(s.Stats())
+	}
+	return stats
+}
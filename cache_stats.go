@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// CacheStats reports what a cache backend has been doing since startup.
+// Size is -1 for backends which can't tell how many entries they hold.
+type CacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	StaleHits   uint64 `json:"stale_hits"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Size        int64  `json:"size"`
+}
+
+// add sums up the stats of several shards or layers.
+func (s CacheStats) add(o CacheStats) CacheStats {
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.StaleHits += o.StaleHits
+	s.Evictions += o.Evictions
+	s.Expirations += o.Expirations
+	s.Size += o.Size
+	return s
+}
+
+// cacheCounters are the event counters shared by the cache backends.
+type cacheCounters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	staleHits   atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+}
+
+func (c *cacheCounters) stats(size int64) CacheStats {
+	return CacheStats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		StaleHits:   c.staleHits.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+		Size:        size,
+	}
+}
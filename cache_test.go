@@ -0,0 +1,510 @@
+package main
+
+import (
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testKey(name string) CacheKey {
+	return CacheKey{Name: dns.Fqdn(name), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+}
+
+func newTestMsg(name string, ttls ...uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	for _, ttl := range ttls {
+		rr, _ := dns.NewRR(dns.Fqdn(name) + " 0 IN A 127.0.0.1")
+		rr.Header().Ttl = ttl
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	Convey("Memory cache honors record TTLs", t, func() {
+		c := &MemoryCache{
+			Backend: make(map[CacheKey]*Msg),
+			Expire:  600 * time.Second,
+			MinTTL:  10 * time.Second,
+			MaxTTL:  300 * time.Second,
+		}
+
+		Convey("expiry follows the minimum TTL", func() {
+			So(c.Set(testKey("a"), newTestMsg("a.com", 30, 60)), ShouldBeNil)
+			So(c.Backend[testKey("a")].Expire.Sub(c.Backend[testKey("a")].Stored), ShouldEqual, 30*time.Second)
+		})
+
+		Convey("TTLs are clamped to min-ttl and max-ttl", func() {
+			So(c.Set(testKey("low"), newTestMsg("low.com", 1)), ShouldBeNil)
+			So(c.Set(testKey("high"), newTestMsg("high.com", 3600)), ShouldBeNil)
+
+			m, err := c.Get(testKey("low"))
+			So(err, ShouldBeNil)
+			So(m.Answer[0].Header().Ttl, ShouldEqual, 10)
+
+			m, err = c.Get(testKey("high"))
+			So(err, ShouldBeNil)
+			So(m.Answer[0].Header().Ttl, ShouldEqual, 300)
+		})
+
+		Convey("messages without records fall back to expire", func() {
+			So(c.Set(testKey("empty"), newTestMsg("empty.com")), ShouldBeNil)
+			So(c.Backend[testKey("empty")].Expire.Sub(c.Backend[testKey("empty")].Stored), ShouldEqual, c.Expire)
+		})
+
+		Convey("served TTLs count down", func() {
+			So(c.Set(testKey("b"), newTestMsg("b.com", 30, 60)), ShouldBeNil)
+			e := c.Backend[testKey("b")]
+			e.Stored = e.Stored.Add(-20 * time.Second)
+			e.Expire = e.Expire.Add(-20 * time.Second)
+			c.Backend[testKey("b")] = e
+
+			m, err := c.Get(testKey("b"))
+			So(err, ShouldBeNil)
+			So(m.Answer[0].Header().Ttl, ShouldBeLessThanOrEqualTo, 10)
+			So(m.Answer[1].Header().Ttl, ShouldBeLessThanOrEqualTo, 10)
+
+			Convey("without touching the cached message", func() {
+				So(c.Backend[testKey("b")].Msg.Answer[0].Header().Ttl, ShouldEqual, 30)
+			})
+		})
+
+		Convey("expired entries are not served", func() {
+			So(c.Set(testKey("c"), newTestMsg("c.com", 30)), ShouldBeNil)
+			e := c.Backend[testKey("c")]
+			e.Expire = time.Now().Add(-time.Second)
+			c.Backend[testKey("c")] = e
+
+			_, err := c.Get(testKey("c"))
+			So(err, ShouldHaveSameTypeAs, KeyExpired{})
+		})
+	})
+}
+
+func newTestNegativeMsg(name string, rcode int, ttl, minttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	m.Rcode = rcode
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "a.gtld-servers.net.",
+		Mbox:   "nstld.verisign-grs.com.",
+		Minttl: minttl,
+	})
+	return m
+}
+
+func TestNegativeCache(t *testing.T) {
+	Convey("Negative answers are cached by their SOA", t, func() {
+		c := &MemoryCache{
+			Backend: make(map[CacheKey]*Msg),
+			Expire:  600 * time.Second,
+			MaxTTL:  3600 * time.Second,
+		}
+
+		Convey("NXDOMAIN and NODATA with SOA are negative", func() {
+			So(isNegative(newTestNegativeMsg("a.com", dns.RcodeNameError, 900, 60)), ShouldBeTrue)
+			So(isNegative(newTestNegativeMsg("a.com", dns.RcodeSuccess, 900, 60)), ShouldBeTrue)
+			So(isNegative(newTestNegativeMsg("a.com", dns.RcodeServerFailure, 900, 60)), ShouldBeFalse)
+			So(isNegative(newTestMsg("a.com")), ShouldBeFalse)
+			So(isNegative(newTestMsg("a.com", 60)), ShouldBeFalse)
+		})
+
+		Convey("the SOA minimum bounds the lifetime", func() {
+			So(c.Set(testKey("nx"), newTestNegativeMsg("nx.com", dns.RcodeNameError, 900, 60)), ShouldBeNil)
+			So(c.Backend[testKey("nx")].Expire.Sub(c.Backend[testKey("nx")].Stored), ShouldEqual, 60*time.Second)
+
+			m, err := c.Get(testKey("nx"))
+			So(err, ShouldBeNil)
+			So(m.Rcode, ShouldEqual, dns.RcodeNameError)
+			So(m.Ns[0].Header().Ttl, ShouldEqual, 60)
+		})
+
+		Convey("the SOA TTL bounds the lifetime", func() {
+			So(c.Set(testKey("nodata"), newTestNegativeMsg("nodata.com", dns.RcodeSuccess, 30, 300)), ShouldBeNil)
+			So(c.Backend[testKey("nodata")].Expire.Sub(c.Backend[testKey("nodata")].Stored), ShouldEqual, 30*time.Second)
+		})
+	})
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	Convey("A full memory cache evicts by its policy", t, func() {
+		Convey("lru drops the least recently used entry", func() {
+			c := NewMemoryCache(CacheConf{Expire: 600, MaxCount: 2, Eviction: "lru"})
+			So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+			So(c.Set(testKey("b"), newTestMsg("b.com", 60)), ShouldBeNil)
+			_, err := c.Get(testKey("a"))
+			So(err, ShouldBeNil)
+
+			So(c.Set(testKey("c"), newTestMsg("c.com", 60)), ShouldBeNil)
+			So(c.Length(), ShouldEqual, 2)
+			So(c.Exists(testKey("a")), ShouldBeTrue)
+			So(c.Exists(testKey("b")), ShouldBeFalse)
+			So(c.Exists(testKey("c")), ShouldBeTrue)
+		})
+
+		Convey("lfu drops the least frequently used entry", func() {
+			c := NewMemoryCache(CacheConf{Expire: 600, MaxCount: 2, Eviction: "lfu"})
+			So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+			So(c.Set(testKey("b"), newTestMsg("b.com", 60)), ShouldBeNil)
+			for i := 0; i < 3; i++ {
+				c.Get(testKey("a"))
+			}
+			c.Get(testKey("b"))
+
+			So(c.Set(testKey("c"), newTestMsg("c.com", 60)), ShouldBeNil)
+			So(c.Exists(testKey("a")), ShouldBeTrue)
+			So(c.Exists(testKey("b")), ShouldBeFalse)
+			So(c.Exists(testKey("c")), ShouldBeTrue)
+		})
+
+		Convey("lfu keeps the hits of a refreshed entry", func() {
+			c := NewMemoryCache(CacheConf{Expire: 600, MaxCount: 3, Eviction: "lfu"})
+			So(c.Set(testKey("hot"), newTestMsg("hot.com", 60)), ShouldBeNil)
+			for i := 0; i < 5; i++ {
+				c.Get(testKey("hot"))
+			}
+			So(c.Set(testKey("hot"), newTestMsg("hot.com", 60)), ShouldBeNil)
+			So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+			So(c.Set(testKey("b"), newTestMsg("b.com", 60)), ShouldBeNil)
+
+			So(c.Set(testKey("c"), newTestMsg("c.com", 60)), ShouldBeNil)
+			So(c.Set(testKey("d"), newTestMsg("d.com", 60)), ShouldBeNil)
+			So(c.Exists(testKey("hot")), ShouldBeTrue)
+			So(c.Exists(testKey("a")), ShouldBeFalse)
+			So(c.Exists(testKey("b")), ShouldBeFalse)
+		})
+
+		Convey("none refuses new entries", func() {
+			c := NewMemoryCache(CacheConf{Expire: 600, MaxCount: 1, Eviction: "none"})
+			So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+			So(c.Set(testKey("b"), newTestMsg("b.com", 60)), ShouldHaveSameTypeAs, CacheIsFull{})
+			So(c.Set(testKey("a"), newTestMsg("a.com", 30)), ShouldBeNil)
+		})
+	})
+
+	Convey("Expired entries are swept", t, func() {
+		c := NewMemoryCache(CacheConf{Expire: 600})
+		So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+		So(c.Set(testKey("b"), newTestMsg("b.com", 600)), ShouldBeNil)
+
+		So(c.removeExpired(time.Now().Add(120*time.Second)), ShouldEqual, 1)
+		So(c.Exists(testKey("a")), ShouldBeFalse)
+		So(c.Exists(testKey("b")), ShouldBeTrue)
+	})
+}
+
+func TestShardedMemoryCache(t *testing.T) {
+	Convey("Sharded memory cache behaves like a memory cache", t, func() {
+		c := NewShardedMemoryCache(CacheConf{Expire: 600, MaxCount: 64, Shards: 4})
+		for i := 0; i < 100; i++ {
+			So(c.Set(testKey(strconv.Itoa(i)), newTestMsg("a.com", 60)), ShouldBeNil)
+		}
+
+		So(c.Length(), ShouldBeLessThanOrEqualTo, 64)
+		So(c.Exists(testKey("99")), ShouldBeTrue)
+		m, err := c.Get(testKey("99"))
+		So(err, ShouldBeNil)
+		So(m.Answer, ShouldHaveLength, 1)
+
+		So(c.Remove(testKey("99")), ShouldBeNil)
+		So(c.Exists(testKey("99")), ShouldBeFalse)
+	})
+
+	Convey("One sweeper sweeps every shard", t, func() {
+		before := runtime.NumGoroutine()
+		c := NewShardedMemoryCache(CacheConf{Expire: 600, Shards: 16, Sweep: 1})
+		So(runtime.NumGoroutine()-before, ShouldBeLessThanOrEqualTo, 1)
+
+		for i := 0; i < 100; i++ {
+			So(c.Set(testKey(strconv.Itoa(i)), newTestMsg("a.com", 60)), ShouldBeNil)
+		}
+		for _, s := range c.shards {
+			So(s.sweeping, ShouldBeTrue)
+			s.mu.Lock()
+			for _, e := range s.Backend {
+				e.Expire = e.Expire.Add(-time.Hour)
+			}
+			s.mu.Unlock()
+		}
+		for i := 0; i < 30 && c.Length() > 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		So(c.Length(), ShouldEqual, 0)
+	})
+}
+
+func benchmarkCache(b *testing.B, c Cache) {
+	keys := make([]CacheKey, 10000)
+	msg := newTestMsg("a.com", 600)
+	for i := range keys {
+		keys[i] = testKey("host" + strconv.Itoa(i) + ".com")
+		c.Set(keys[i], msg)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(len(keys))
+		for pb.Next() {
+			i = (i + 1) % len(keys)
+			if i%10 == 0 {
+				c.Set(keys[i], msg)
+			} else {
+				c.Get(keys[i])
+			}
+		}
+	})
+}
+
+func BenchmarkMemoryCache(b *testing.B) {
+	benchmarkCache(b, NewMemoryCache(CacheConf{Expire: 600}))
+}
+
+func BenchmarkShardedMemoryCache(b *testing.B) {
+	benchmarkCache(b, NewShardedMemoryCache(CacheConf{Expire: 600, Shards: 16}))
+}
+
+func TestMemoryCacheStale(t *testing.T) {
+	Convey("Expired entries are served stale within the stale window", t, func() {
+		c := NewMemoryCache(CacheConf{Expire: 600, StaleTTL: 3600})
+		So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+		e := c.Backend[testKey("a")]
+		e.Stored = e.Stored.Add(-120 * time.Second)
+		e.Expire = e.Expire.Add(-120 * time.Second)
+		c.Backend[testKey("a")] = e
+
+		_, err := c.Get(testKey("a"))
+		So(err, ShouldHaveSameTypeAs, KeyExpired{})
+
+		m, err := c.GetStale(testKey("a"))
+		So(err, ShouldBeNil)
+		So(m.Answer[0].Header().Ttl, ShouldEqual, 0)
+
+		Convey("and swept after it", func() {
+			So(c.removeExpired(time.Now()), ShouldEqual, 0)
+			So(c.removeExpired(time.Now().Add(3600*time.Second)), ShouldEqual, 1)
+
+			_, err = c.GetStale(testKey("a"))
+			So(err, ShouldHaveSameTypeAs, KeyNotFound{})
+		})
+	})
+}
+
+func TestMemoryCachePrefetch(t *testing.T) {
+	Convey("Popular entries close to expiry need a prefetch", t, func() {
+		c := NewMemoryCache(CacheConf{Expire: 600, Prefetch: 10, PrefetchHits: 2})
+		So(c.Set(testKey("a"), newTestMsg("a.com", 100)), ShouldBeNil)
+		So(c.NeedPrefetch(testKey("a")), ShouldBeFalse)
+
+		e := c.Backend[testKey("a")]
+		e.Stored = e.Stored.Add(-95 * time.Second)
+		e.Expire = e.Expire.Add(-95 * time.Second)
+		So(c.NeedPrefetch(testKey("a")), ShouldBeFalse)
+
+		c.Get(testKey("a"))
+		c.Get(testKey("a"))
+		So(c.NeedPrefetch(testKey("a")), ShouldBeTrue)
+
+		Convey("but not if they were refreshed", func() {
+			So(c.Set(testKey("a"), newTestMsg("a.com", 100)), ShouldBeNil)
+			So(c.NeedPrefetch(testKey("a")), ShouldBeFalse)
+		})
+	})
+}
+
+func TestMemoryCacheStats(t *testing.T) {
+	Convey("Memory cache counts its events", t, func() {
+		c := NewMemoryCache(CacheConf{Expire: 600, MaxCount: 2, StaleTTL: 60})
+		So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+		So(c.Set(testKey("b"), newTestMsg("b.com", 60)), ShouldBeNil)
+		c.Get(testKey("a"))
+		c.Get(testKey("c"))
+		So(c.Set(testKey("c"), newTestMsg("c.com", 60)), ShouldBeNil)
+
+		c.Backend[testKey("c")].Expire = time.Now().Add(-time.Second)
+		c.Get(testKey("c"))
+		c.GetStale(testKey("c"))
+		c.removeExpired(time.Now().Add(time.Hour))
+
+		So(c.Stats(), ShouldResemble, CacheStats{
+			Hits:        1,
+			Misses:      2,
+			StaleHits:   1,
+			Evictions:   1,
+			Expirations: 2,
+			Size:        0,
+		})
+	})
+}
+
+func TestRemoteCaches(t *testing.T) {
+	redisStandin := newRedisStandin(t)
+	memcacheStandin := newMemcacheStandin(t)
+
+	backends := map[string]Cache{
+		"redis":    NewRedisCache(redisStandin.conf(), CacheConf{Expire: 300}, "godns:test:"),
+		"memcache": NewMemcachedCache([]string{memcacheStandin.addr}, CacheConf{Expire: 300}, "godns:test:"),
+	}
+
+	for name, c := range backends {
+		Convey("Entries round trip through "+name, t, func() {
+			Convey("positive answers", func() {
+				So(c.Set(testKey("a.com"), newTestMsg("a.com", 60)), ShouldBeNil)
+				So(c.Exists(testKey("a.com")), ShouldBeTrue)
+
+				m, err := c.Get(testKey("a.com"))
+				So(err, ShouldBeNil)
+				So(m.Answer, ShouldHaveLength, 1)
+				So(m.Answer[0].Header().Ttl, ShouldBeBetweenOrEqual, 59, 60)
+			})
+
+			Convey("negative answers", func() {
+				So(c.Set(testKey("nx.com"), newTestNegativeMsg("nx.com", dns.RcodeNameError, 900, 60)), ShouldBeNil)
+
+				m, err := c.Get(testKey("nx.com"))
+				So(err, ShouldBeNil)
+				So(m.Rcode, ShouldEqual, dns.RcodeNameError)
+				So(m.Ns[0].Header().Ttl, ShouldBeLessThanOrEqualTo, 60)
+			})
+
+			Convey("failures without message", func() {
+				So(c.Set(testKey("fail.com"), nil), ShouldBeNil)
+
+				m, err := c.Get(testKey("fail.com"))
+				So(err, ShouldBeNil)
+				So(m, ShouldBeNil)
+			})
+
+			Convey("missing and removed entries", func() {
+				So(c.Exists(testKey("missing.com")), ShouldBeFalse)
+				_, err := c.Get(testKey("missing.com"))
+				So(err, ShouldHaveSameTypeAs, KeyNotFound{})
+
+				So(c.Set(testKey("b.com"), newTestMsg("b.com", 60)), ShouldBeNil)
+				So(c.Remove(testKey("b.com")), ShouldBeNil)
+				So(c.Exists(testKey("b.com")), ShouldBeFalse)
+			})
+		})
+	}
+
+	Convey("Remote entries are kept within the TTL bounds", t, func() {
+		stores := map[string]*standinStore{"redis": &redisStandin.standinStore, "memcache": &memcacheStandin.standinStore}
+		bounded := map[string][2]Cache{
+			"redis": {
+				NewRedisCache(redisStandin.conf(), CacheConf{Expire: 300, MinTTL: 120}, "godns:bounds:"),
+				NewRedisCache(redisStandin.conf(), CacheConf{Expire: 300, MaxTTL: 30}, "godns:neg:"),
+			},
+			"memcache": {
+				NewMemcachedCache([]string{memcacheStandin.addr}, CacheConf{Expire: 300, MinTTL: 120}, "godns:bounds:"),
+				NewMemcachedCache([]string{memcacheStandin.addr}, CacheConf{Expire: 300, MaxTTL: 30}, "godns:neg:"),
+			},
+		}
+		for name, caches := range bounded {
+			expiry := func(key string) time.Duration {
+				store := stores[name]
+				store.mu.Lock()
+				defer store.mu.Unlock()
+				return time.Until(store.data[key].expire)
+			}
+			c, neg := caches[0], caches[1]
+
+			So(c.Set(testKey("a.com"), newTestMsg("a.com", 60)), ShouldBeNil)
+			m, err := c.Get(testKey("a.com"))
+			So(err, ShouldBeNil)
+			So(m.Answer[0].Header().Ttl, ShouldBeBetweenOrEqual, 119, 120)
+			So(expiry("godns:bounds:a.com.:IN:A"), ShouldBeBetween, 110*time.Second, 121*time.Second)
+
+			So(neg.Set(testKey("nx.com"), newTestNegativeMsg("nx.com", dns.RcodeNameError, 86400, 86400)), ShouldBeNil)
+			m, err = neg.Get(testKey("nx.com"))
+			So(err, ShouldBeNil)
+			So(m.Ns[0].Header().Ttl, ShouldBeLessThanOrEqualTo, 30)
+			So(expiry("godns:neg:nx.com.:IN:A"), ShouldBeBetween, 20*time.Second, 31*time.Second)
+		}
+
+		saved := conf
+		defer func() { conf = saved }()
+		conf = Conf{Redis: redisStandin.conf(), Cache: CacheConf{Backend: "redis", Expire: 600, MinTTL: 5, MaxTTL: 3600, NegMaxTTL: 300}}
+		h := NewHandler()
+		So(h.cache.(*RedisCache).ttlBounds, ShouldResemble, ttlBounds{minTTL: 5 * time.Second, maxTTL: time.Hour})
+		So(h.negCache.(*RedisCache).ttlBounds, ShouldResemble, ttlBounds{minTTL: 5 * time.Second, maxTTL: 5 * time.Minute})
+	})
+
+	Convey("Entries are stored under readable keys", t, func() {
+		So(backends["redis"].Set(testKey("www.a.com"), newTestMsg("www.a.com", 60)), ShouldBeNil)
+		_, ok := redisStandin.get("godns:test:www.a.com.:IN:A")
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Values of an unknown format are rejected", t, func() {
+		redisStandin.set("godns:test:old.com.:IN:A", []byte("nil"), 0)
+		_, err := backends["redis"].Get(testKey("old.com"))
+		So(err, ShouldHaveSameTypeAs, SerializerError{})
+	})
+}
+
+func TestEnvelope(t *testing.T) {
+	Convey("Envelopes count TTLs down from when they were stored", t, func() {
+		now := time.Now()
+		b, err := packEnvelope(newTestMsg("a.com", 60), 60, now.Add(-20*time.Second))
+		So(err, ShouldBeNil)
+		So(b[0], ShouldEqual, envelopeVersion)
+
+		m, err := unpackEnvelope(b, now)
+		So(err, ShouldBeNil)
+		So(m.Answer[0].Header().Ttl, ShouldEqual, 40)
+
+		b, err = packEnvelope(nil, 30, now)
+		So(err, ShouldBeNil)
+		So(b[1]&envelopeNil, ShouldNotEqual, 0)
+		m, err = unpackEnvelope(b, now)
+		So(err, ShouldBeNil)
+		So(m, ShouldBeNil)
+
+		_, err = unpackEnvelope(b[:3], now)
+		So(err, ShouldHaveSameTypeAs, SerializerError{})
+	})
+}
+
+func TestLayeredCache(t *testing.T) {
+	Convey("A memory L1 sits in front of a remote L2", t, func() {
+		standin := newRedisStandin(t)
+		l1 := NewMemoryCache(CacheConf{Expire: 600})
+		l2 := NewRedisCache(standin.conf(), CacheConf{Expire: 300}, "godns:test:")
+		c := NewLayeredCache(l1, l2)
+
+		Convey("writes go to both layers", func() {
+			So(c.Set(testKey("a.com"), newTestMsg("a.com", 60)), ShouldBeNil)
+			So(l1.Exists(testKey("a.com")), ShouldBeTrue)
+			So(l2.Exists(testKey("a.com")), ShouldBeTrue)
+		})
+
+		Convey("L2 hits populate L1", func() {
+			So(l2.Set(testKey("b.com"), newTestMsg("b.com", 60)), ShouldBeNil)
+			So(l1.Exists(testKey("b.com")), ShouldBeFalse)
+
+			m, err := c.Get(testKey("b.com"))
+			So(err, ShouldBeNil)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(l1.Exists(testKey("b.com")), ShouldBeTrue)
+			So(l1.Backend[testKey("b.com")].Expire.Sub(l1.Backend[testKey("b.com")].Stored), ShouldBeLessThanOrEqualTo, 60*time.Second)
+
+			Convey("and L1 answers without asking L2", func() {
+				standin.flush()
+				_, err = c.Get(testKey("b.com"))
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("removes go to both layers", func() {
+			So(c.Set(testKey("c.com"), newTestMsg("c.com", 60)), ShouldBeNil)
+			So(c.Remove(testKey("c.com")), ShouldBeNil)
+			So(c.Exists(testKey("c.com")), ShouldBeFalse)
+		})
+	})
+}
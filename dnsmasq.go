@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Special values of the domain servers, as in dnsmasq.
+const (
+	// serverDefault sends the names of a domain to the default upstreams,
+	// from server=/domain/#.
+	serverDefault = "#"
+	// serverLocal never forwards the names of a domain, from local=/domain/
+	// or server=/domain/: they are answered from the hosts or NXDOMAIN.
+	serverLocal = "-"
+)
+
+// parseDirective adds a dnsmasq directive of a server-list file to rt:
+//
+//	server=8.8.8.8#53
+//	server=/a.com/b.com/8.8.8.8, local=/lan/, server=/a.com/#
+//	address=/ads.com/0.0.0.0, address=/ads.com/#, address=/ads.com/
+//	rev-server=192.168.0.0/16,192.168.0.1
+//	bogus-nxdomain=64.94.110.11
+//
+// Other directives are ignored.
+func (r *Resolver) parseDirective(rt *routes, line string) error {
+	kv := strings.SplitN(line, "=", 2)
+	if len(kv) != 2 {
+		return nil
+	}
+	key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+	switch key {
+	case "server", "local":
+		if !strings.HasPrefix(value, "/") {
+			u, err := r.upstreams.get(value)
+			if err != nil {
+				return err
+			}
+			rt.servers = append(rt.servers, u)
+			return nil
+		}
+		domains, spec, err := splitDomains(value)
+		if err != nil {
+			return err
+		}
+		switch spec {
+		case "":
+			spec = serverLocal
+		case serverDefault:
+		default:
+			if _, err := r.upstreams.get(spec); err != nil {
+				return err
+			}
+		}
+		for _, domain := range domains {
+			rt.domainServer.sinsert(domainKeys(domain), spec)
+		}
+	case "address":
+		domains, spec, err := splitDomains(value)
+		if err != nil {
+			return err
+		}
+		for _, domain := range domains {
+			switch spec {
+			case "":
+				rt.domainServer.sinsert(domainKeys(domain), serverLocal)
+			case serverDefault:
+				rt.domainAddress.sinsert(domainKeys(domain), "0.0.0.0")
+				rt.domainAddress.sinsert(domainKeys(domain), "::")
+			default:
+				if !isIP(spec) {
+					return fmt.Errorf("invalid address %s", spec)
+				}
+				rt.domainAddress.sinsert(domainKeys(domain), spec)
+			}
+		}
+	case "rev-server":
+		kv := strings.SplitN(value, ",", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("rev-server needs a network and a server")
+		}
+		nets, err := parseNets([]string{strings.TrimSpace(kv[0])})
+		if err != nil {
+			return err
+		}
+		spec := strings.TrimSpace(kv[1])
+		if _, err := r.upstreams.get(spec); err != nil {
+			return err
+		}
+		for _, zone := range reverseZones(nets[0]) {
+			rt.domainServer.sinsert(domainKeys(zone), spec)
+		}
+	case "bogus-nxdomain":
+		nets, err := parseNets([]string{value})
+		if err != nil {
+			return err
+		}
+		rt.bogus = append(rt.bogus, nets...)
+	}
+	return nil
+}
+
+// splitDomains splits /a.com/b.com/spec into its domains and spec. The spec
+// of godns may be an URL, holding slashes itself.
+func splitDomains(value string) ([]string, string, error) {
+	end := strings.LastIndex(value, "/")
+	if i := strings.Index(value, "://"); i >= 0 {
+		end = strings.LastIndex(value[:i], "/")
+	}
+	if end <= 0 {
+		return nil, "", fmt.Errorf("no domain in %s", value)
+	}
+
+	var domains []string
+	for _, domain := range strings.Split(value[1:end], "/") {
+		if !isDomainSuffix(domain) {
+			return nil, "", fmt.Errorf("invalid domain %s", domain)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, value[end+1:], nil
+}
+
+// domainKeys returns the keys of the suffix trees for a domain.
+func domainKeys(domain string) []string {
+	return strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+}
+
+// reverseZones returns the reverse lookup zones of n. A prefix which isn't
+// on a label boundary, octets for IPv4 and nibbles for IPv6, is covered by
+// the zones of every value of its last, partial label. The family is that
+// of the mask, IPv4-mapped IPv6 networks are IPv6 ones.
+func reverseZones(n *net.IPNet) []string {
+	ones, bits := n.Mask.Size()
+	var labels []int
+	unit, suffix, format := 8, "in-addr.arpa", "%d"
+	if bits == 8*net.IPv4len {
+		for _, b := range n.IP.To4() {
+			labels = append(labels, int(b))
+		}
+	} else {
+		unit, suffix, format = 4, "ip6.arpa", "%x"
+		for _, b := range n.IP.To16() {
+			labels = append(labels, int(b>>4), int(b&0xf))
+		}
+	}
+
+	full, partial := ones/unit, ones%unit
+	zone := suffix
+	for _, l := range labels[:full] {
+		zone = fmt.Sprintf(format, l) + "." + zone
+	}
+	if partial == 0 {
+		return []string{zone}
+	}
+
+	var zones []string
+	first := labels[full]
+	for l := first; l < first+1<<(unit-partial); l++ {
+		zones = append(zones, fmt.Sprintf(format, l)+"."+zone)
+	}
+	return zones
+}
+
+// LocalAnswer returns the answer of the address and local directives to
+// req, nil if it is to be forwarded. The most specific domain wins, an
+// address over a server of the same domain.
+func (r *Resolver) LocalAnswer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	keys := domainKeys(q.Name)
+	rt := r.routes.Load()
+	addresses, addressDepth := rt.domainAddress.longest(keys)
+	specs, serverDepth := rt.domainServer.longest(keys)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	switch {
+	case addressDepth > 0 && addressDepth >= serverDepth:
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: conf.Hosts.TTL}
+			switch {
+			case q.Qtype == dns.TypeA && ip.To4() != nil:
+				hdr.Rrtype = dns.TypeA
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+			case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+				hdr.Rrtype = dns.TypeAAAA
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		return m
+	case serverDepth > 0 && containsString(specs, serverLocal):
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+	return nil
+}
+
+// isBogus tells whether m answers with an address of a bogus-nxdomain
+// network.
+func (r *Resolver) isBogus(m *dns.Msg) bool {
+	bogus := r.routes.Load().bogus
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		for _, n := range bogus {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
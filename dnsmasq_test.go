@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDnsmasqDirectives(t *testing.T) {
+	Convey("Server-list files take the dnsmasq directives", t, func() {
+		h := newTestHandler(t)
+		file := filepath.Join(t.TempDir(), "dnsmasq.conf")
+		So(os.WriteFile(file, []byte(strings.Join([]string{
+			"# comment",
+			"server=192.0.2.53",
+			"server=/a.example/b.example/10.0.0.1",
+			"server=/www.a.example/#",
+			"local=/lan/",
+			"server=/corp.example/",
+			"address=/ads.example/0.0.0.0",
+			"address=/ads.example/::",
+			"server=/ok.ads.example/10.0.0.2",
+			"address=/null.example/#",
+			"address=/gone.example/",
+			"rev-server=192.168.0.0/16,10.0.0.3",
+			"rev-server=::ffff:172.16.0.0/108,10.0.0.4",
+			"bogus-nxdomain=198.51.100.1",
+			"server=/bad domain/10.0.0.1",
+			"conf-dir=/etc/dnsmasq.d",
+		}, "\n")), 0o644), ShouldBeNil)
+		r := h.resolver
+		r.config.ServerListFile = file
+		rt, err := r.loadRoutes()
+		So(err, ShouldBeNil) // the bad domain is skipped
+		r.routes.Store(rt)
+
+		names := func(qname string) []string {
+			var ss []string
+			for _, u := range r.Nameservers(qname) {
+				ss = append(ss, u.String())
+			}
+			return ss
+		}
+		local := func(qname string, qtype uint16) *dns.Msg {
+			req := new(dns.Msg)
+			req.SetQuestion(qname, qtype)
+			return r.LocalAnswer(req)
+		}
+
+		Convey("server with several domains and #", func() {
+			So(names("x.a.example."), ShouldResemble, []string{"10.0.0.1:53"})
+			So(names("X.B.Example."), ShouldResemble, []string{"10.0.0.1:53"})
+			So(names("x.www.a.example."), ShouldResemble, []string{"192.0.2.53:53"})
+			So(names("x.c.example."), ShouldResemble, []string{"192.0.2.53:53"})
+			So(local("x.a.example.", dns.TypeA), ShouldBeNil)
+		})
+
+		Convey("local and empty server are never forwarded", func() {
+			for _, qname := range []string{"host.lan.", "www.corp.example.", "gone.example."} {
+				m := local(qname, dns.TypeA)
+				So(m, ShouldNotBeNil)
+				So(m.Rcode, ShouldEqual, dns.RcodeNameError)
+			}
+		})
+
+		Convey("address answers of its family, the most specific domain wins", func() {
+			m := local("x.ads.example.", dns.TypeA)
+			So(m.Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "0.0.0.0")
+
+			m = local("x.ads.example.", dns.TypeAAAA)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].(*dns.AAAA).AAAA.String(), ShouldEqual, "::")
+
+			m = local("x.ads.example.", dns.TypeMX)
+			So(m.Rcode, ShouldEqual, dns.RcodeSuccess)
+			So(m.Answer, ShouldBeEmpty)
+
+			So(local("x.ok.ads.example.", dns.TypeA), ShouldBeNil)
+			So(names("x.ok.ads.example."), ShouldResemble, []string{"10.0.0.2:53"})
+
+			So(local("null.example.", dns.TypeAAAA).Answer, ShouldHaveLength, 1)
+		})
+
+		Convey("rev-server forwards the reverse zone", func() {
+			So(names("1.0.168.192.in-addr.arpa."), ShouldResemble, []string{"10.0.0.3:53"})
+			So(names("1.0.167.192.in-addr.arpa."), ShouldResemble, []string{"192.0.2.53:53"})
+			So(names("1.0.0.0.0.1.c.a.f.f.f.f."+strings.Repeat("0.", 20)+"ip6.arpa."), ShouldResemble, []string{"10.0.0.4:53"})
+		})
+
+		Convey("bogus-nxdomain turns answers into NXDOMAIN", func() {
+			bogus := newUpstreamStandin(t, "198.51.100.1", 60)
+			u, _ := r.upstreams.get(strings.Replace(bogus.addr, ":", "#", 1))
+			r.routes.Load().servers = []*Upstream{u}
+
+			req := new(dns.Msg)
+			req.SetQuestion("typo.example.", dns.TypeA)
+			m, err := r.Lookup("udp", req)
+			So(err, ShouldBeNil)
+			So(m.Rcode, ShouldEqual, dns.RcodeNameError)
+			So(m.Answer, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Reverse zones cover networks off the label boundaries", t, func() {
+		zones := func(cidr string) []string {
+			_, n, err := net.ParseCIDR(cidr)
+			So(err, ShouldBeNil)
+			return reverseZones(n)
+		}
+		So(zones("10.0.0.0/8"), ShouldResemble, []string{"10.in-addr.arpa"})
+		So(zones("192.168.4.0/22"), ShouldResemble, []string{
+			"4.168.192.in-addr.arpa", "5.168.192.in-addr.arpa", "6.168.192.in-addr.arpa", "7.168.192.in-addr.arpa"})
+		So(zones("fd00::/8"), ShouldResemble, []string{"d.f.ip6.arpa"})
+		So(zones("fd00::/7"), ShouldResemble, []string{"c.f.ip6.arpa", "d.f.ip6.arpa"})
+
+		mapped := strings.Repeat("0.", 20) + "ip6.arpa"
+		So(zones("::ffff:10.0.0.0/104"), ShouldResemble, []string{"a.0.f.f.f.f." + mapped})
+		So(zones("::ffff:10.0.0.0/106"), ShouldResemble, []string{
+			"0.a.0.f.f.f.f." + mapped, "1.a.0.f.f.f.f." + mapped, "2.a.0.f.f.f.f." + mapped, "3.a.0.f.f.f.f." + mapped})
+	})
+}
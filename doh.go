@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMediaType  = "application/dns-message"
+	dohJSONType   = "application/dns-json"
+	dohMaxMsgSize = dns.MaxMsgSize
+)
+
+// DoHServer answers DNS-over-HTTPS queries (RFC 8484) on path, in wire
+// format by GET or POST, and in the JSON format by GET with a name
+// parameter. Without certs it serves plain HTTP, for use behind a proxy
+// which terminates TLS.
+type DoHServer struct {
+	listen  string
+	path    string
+	handler dns.Handler
+	certs   *certReloader
+}
+
+// httpServer returns the HTTP server of the endpoint, over TLS if the
+// DoH server has certificates.
+func (d *DoHServer) httpServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(d.path, d)
+	srv := &http.Server{Addr: d.listen, Handler: mux}
+	if d.certs != nil {
+		srv.TLSConfig = d.certs.TLSConfig()
+	}
+	return srv
+}
+
+func (d *DoHServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, jsonAPI, err := d.parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohWriter{remote: r.RemoteAddr}
+	d.handler.ServeDNS(dw, req)
+	if dw.msg == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+
+	if ttl, ok := msgTTL(dw.msg); ok && dw.msg.Rcode != dns.RcodeServerFailure {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	if jsonAPI {
+		w.Header().Set("Content-Type", dohJSONType)
+		if err = json.NewEncoder(w).Encode(newDoHJSON(dw.msg)); err != nil {
+			logger.Warn("Write doh response failed: %s", err)
+		}
+		return
+	}
+
+	b, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if _, err = w.Write(b); err != nil {
+		logger.Warn("Write doh response failed: %s", err)
+	}
+}
+
+// parseRequest returns the query of r, and whether it uses the JSON format.
+func (d *DoHServer) parseRequest(r *http.Request) (*dns.Msg, bool, error) {
+	var b []byte
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if q.Get("name") != "" {
+			req, err := parseDoHJSONQuery(q.Get("name"), q.Get("type"), q.Get("do"), q.Get("cd"))
+			return req, true, err
+		}
+		s := q.Get("dns")
+		if s == "" {
+			return nil, false, fmt.Errorf("missing dns or name parameter")
+		}
+		var err error
+		if b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err != nil {
+			return nil, false, fmt.Errorf("invalid dns parameter: %v", err)
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+			return nil, false, fmt.Errorf("unsupported content type %q", ct)
+		}
+		var err error
+		if b, err = io.ReadAll(io.LimitReader(r.Body, dohMaxMsgSize+1)); err != nil {
+			return nil, false, err
+		}
+		if len(b) > dohMaxMsgSize {
+			return nil, false, fmt.Errorf("message too large")
+		}
+	default:
+		return nil, false, fmt.Errorf("unsupported method %s", r.Method)
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(b); err != nil {
+		return nil, false, fmt.Errorf("invalid dns message: %v", err)
+	}
+	if len(req.Question) != 1 {
+		return nil, false, fmt.Errorf("need exactly one question")
+	}
+	return req, false, nil
+}
+
+// parseDoHJSONQuery builds the query of a JSON API request. qtype is a type
+// name or number and defaults to A; do and cd are booleans.
+func parseDoHJSONQuery(name, qtype, do, cd string) (*dns.Msg, error) {
+	t := dns.TypeA
+	if qtype != "" {
+		if n, err := strconv.ParseUint(qtype, 10, 16); err == nil {
+			t = uint16(n)
+		} else if n, ok := dns.StringToType[strings.ToUpper(qtype)]; ok {
+			t = n
+		} else {
+			return nil, fmt.Errorf("unknown type %s", qtype)
+		}
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("invalid name %s", name)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), t)
+	req.CheckingDisabled = dohFlag(cd)
+	if dohFlag(do) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return req, nil
+}
+
+func dohFlag(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
+
+// dohJSON is an answer in the JSON format popularized by the public
+// resolvers.
+type dohJSON struct {
+	Status    int               `json:"Status"`
+	TC        bool              `json:"TC"`
+	RD        bool              `json:"RD"`
+	RA        bool              `json:"RA"`
+	AD        bool              `json:"AD"`
+	CD        bool              `json:"CD"`
+	Question  []dohJSONQuestion `json:"Question"`
+	Answer    []dohJSONRR       `json:"Answer,omitempty"`
+	Authority []dohJSONRR       `json:"Authority,omitempty"`
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+func newDoHJSON(m *dns.Msg) dohJSON {
+	j := dohJSON{
+		Status: m.Rcode,
+		TC:     m.Truncated,
+		RD:     m.RecursionDesired,
+		RA:     m.RecursionAvailable,
+		AD:     m.AuthenticatedData,
+		CD:     m.CheckingDisabled,
+	}
+	for _, q := range m.Question {
+		j.Question = append(j.Question, dohJSONQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	j.Answer = newDoHJSONRRs(m.Answer)
+	j.Authority = newDoHJSONRRs(m.Ns)
+	return j
+}
+
+func newDoHJSONRRs(rrs []dns.RR) []dohJSONRR {
+	var j []dohJSONRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		j = append(j, dohJSONRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return j
+}
+
+// dohWriter is the dns.ResponseWriter handed to GODNSHandler for a DoH
+// request. It keeps the answer for the HTTP response.
+type dohWriter struct {
+	remote string
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *dohWriter) RemoteAddr() net.Addr {
+	host, port, err := net.SplitHostPort(w.remote)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDoH(t *testing.T) {
+	Convey("DoH answers wire format and JSON queries", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 300)
+		d := &DoHServer{path: "/dns-query", handler: dns.HandlerFunc(newTestHandler(t, upstream.addr).DoHTTPS)}
+		srv := httptest.NewServer(d)
+		defer srv.Close()
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.Id = 0
+		wire, err := req.Pack()
+		So(err, ShouldBeNil)
+
+		unpack := func(resp *http.Response) *dns.Msg {
+			defer resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(resp.Header.Get("Content-Type"), ShouldEqual, dohMediaType)
+			b, _ := io.ReadAll(resp.Body)
+			m := new(dns.Msg)
+			So(m.Unpack(b), ShouldBeNil)
+			return m
+		}
+
+		Convey("by POST", func() {
+			resp, err := http.Post(srv.URL+"/dns-query", dohMediaType, bytes.NewReader(wire))
+			So(err, ShouldBeNil)
+			So(resp.Header.Get("Cache-Control"), ShouldEqual, "max-age=300")
+			m := unpack(resp)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "192.0.2.1")
+		})
+
+		Convey("by GET, from the cache the second time", func() {
+			url := srv.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(wire)
+			resp, err := http.Get(url)
+			So(err, ShouldBeNil)
+			So(unpack(resp).Answer, ShouldHaveLength, 1)
+
+			resp, err = http.Get(url)
+			So(err, ShouldBeNil)
+			So(unpack(resp).Answer, ShouldHaveLength, 1)
+			So(upstream.queries.Load(), ShouldEqual, 1)
+		})
+
+		Convey("in JSON", func() {
+			resp, err := http.Get(srv.URL + "/dns-query?name=www.example.com&type=a")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			So(resp.Header.Get("Content-Type"), ShouldEqual, dohJSONType)
+
+			var j dohJSON
+			So(json.NewDecoder(resp.Body).Decode(&j), ShouldBeNil)
+			So(j.Status, ShouldEqual, dns.RcodeSuccess)
+			So(j.Question, ShouldResemble, []dohJSONQuestion{{Name: "www.example.com.", Type: dns.TypeA}})
+			So(j.Answer, ShouldHaveLength, 1)
+			So(j.Answer[0].Data, ShouldEqual, "192.0.2.1")
+		})
+
+		Convey("and rejects bad requests", func() {
+			for _, url := range []string{"/dns-query", "/dns-query?dns=!!", "/dns-query?name=www.example.com&type=NOPE"} {
+				resp, err := http.Get(srv.URL + url)
+				So(err, ShouldBeNil)
+				resp.Body.Close()
+				So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+			}
+
+			resp, err := http.Post(srv.URL+"/dns-query", "text/plain", bytes.NewReader(wire))
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Error codes DoQ connections are closed with (RFC 9250 section 4.3).
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.ApplicationErrorCode = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+// DoQServer answers DNS-over-QUIC queries (RFC 9250). Every query comes on
+// its own stream, prefixed by its length, and the answer goes back on the
+// same stream, so a lost packet only delays its own query.
+type DoQServer struct {
+	listen      string
+	handler     dns.Handler
+	certs       *certReloader
+	idleTimeout time.Duration
+	rTimeout    time.Duration
+	wTimeout    time.Duration
+
+	transport *quic.Transport
+	listener  *quic.Listener
+	inflight  sync.WaitGroup
+	mu        sync.Mutex
+	conns     map[quic.Connection]struct{}
+	closing   bool
+}
+
+// Listen binds the udp address of the server.
+func (d *DoQServer) Listen() error {
+	addr, err := net.ResolveUDPAddr("udp", d.listen)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	tlsConf := d.certs.TLSConfig()
+	tlsConf.MinVersion = tls.VersionTLS13
+	tlsConf.NextProtos = []string{"doq"}
+
+	d.transport = &quic.Transport{Conn: pc}
+	d.listener, err = d.transport.Listen(tlsConf, &quic.Config{MaxIdleTimeout: d.idleTimeout})
+	if err != nil {
+		d.transport.Close()
+		return err
+	}
+	d.conns = make(map[quic.Connection]struct{})
+	return nil
+}
+
+// Serve accepts connections until the server is shut down.
+func (d *DoQServer) Serve() error {
+	for {
+		conn, err := d.listener.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return err
+		}
+		d.mu.Lock()
+		d.conns[conn] = struct{}{}
+		d.mu.Unlock()
+		go d.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections, waits for the queries in flight
+// and closes the connections.
+func (d *DoQServer) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+	d.listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	d.mu.Lock()
+	for conn := range d.conns {
+		conn.CloseWithError(doqNoError, "")
+	}
+	d.mu.Unlock()
+	d.transport.Close()
+	return err
+}
+
+// Close releases the socket of a server which never served.
+func (d *DoQServer) Close() error {
+	d.listener.Close()
+	return d.transport.Close()
+}
+
+func (d *DoQServer) String() string {
+	return "quic listener on " + d.listen
+}
+
+// serveConn answers the streams of conn until the client closes it or it
+// stays idle for longer than the idle timeout.
+func (d *DoQServer) serveConn(conn quic.Connection) {
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, conn)
+		d.mu.Unlock()
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		d.mu.Lock()
+		if d.closing {
+			d.mu.Unlock()
+			stream.CancelRead(quic.StreamErrorCode(doqNoError))
+			return
+		}
+		d.inflight.Add(1)
+		d.mu.Unlock()
+
+		go func() {
+			defer d.inflight.Done()
+			d.serveStream(conn, stream)
+		}()
+	}
+}
+
+func (d *DoQServer) serveStream(conn quic.Connection, stream quic.Stream) {
+	defer stream.Close()
+
+	if d.rTimeout > 0 {
+		stream.SetReadDeadline(time.Now().Add(d.rTimeout))
+	}
+	req, err := readDoQMsg(stream)
+	if err != nil {
+		logger.Warn("Read quic query from %s failed: %s", conn.RemoteAddr(), err)
+		conn.CloseWithError(doqProtocolError, err.Error())
+		return
+	}
+	// The ID is always 0 on DoQ, the stream identifies the query.
+	if req.Id != 0 || len(req.Question) != 1 {
+		conn.CloseWithError(doqProtocolError, "invalid query")
+		return
+	}
+
+	if d.wTimeout > 0 {
+		stream.SetWriteDeadline(time.Now().Add(d.wTimeout))
+	}
+	w := &doqWriter{conn: conn, stream: stream}
+	d.handler.ServeDNS(w, req)
+	if !w.written {
+		stream.CancelWrite(quic.StreamErrorCode(doqInternalError))
+	}
+}
+
+// readDoQMsg reads a length prefixed message from r.
+func readDoQMsg(r io.Reader) (*dns.Msg, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeDoQMsg writes m to w, prefixed by its length.
+func writeDoQMsg(w io.Writer, m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+// doqWriter is the dns.ResponseWriter handed to GODNSHandler for a DoQ
+// stream.
+type doqWriter struct {
+	conn    quic.Connection
+	stream  quic.Stream
+	written bool
+}
+
+func (w *doqWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *doqWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+func (w *doqWriter) WriteMsg(m *dns.Msg) error {
+	w.written = true
+	return writeDoQMsg(w.stream, m)
+}
+
+func (w *doqWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	if err := w.WriteMsg(m); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *doqWriter) Close() error        { return w.stream.Close() }
+func (w *doqWriter) TsigStatus() error   { return nil }
+func (w *doqWriter) TsigTimersOnly(bool) {}
+func (w *doqWriter) Hijack()             {}
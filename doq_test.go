@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDoQ(t *testing.T) {
+	Convey("DoQ answers every stream of a connection", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 300)
+		certFile, keyFile := writeTestCert(t, t.TempDir(), "godns")
+		certs, err := newCertReloader(certFile, keyFile)
+		So(err, ShouldBeNil)
+
+		d := &DoQServer{listen: "127.0.0.1:0", handler: dns.HandlerFunc(newTestHandler(t, upstream.addr).DoQUIC), certs: certs, idleTimeout: time.Second, rTimeout: time.Second}
+		So(d.Listen(), ShouldBeNil)
+		go d.Serve()
+		defer d.Shutdown(context.Background())
+
+		pool := x509.NewCertPool()
+		pem, _ := os.ReadFile(certFile)
+		pool.AppendCertsFromPEM(pem)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := quic.DialAddr(ctx, d.listener.Addr().String(), &tls.Config{RootCAs: pool, NextProtos: []string{"doq"}}, nil)
+		So(err, ShouldBeNil)
+		defer conn.CloseWithError(0, "")
+
+		query := func(name string, id uint16) (*dns.Msg, error) {
+			stream, err := conn.OpenStreamSync(ctx)
+			if err != nil {
+				return nil, err
+			}
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			req.Id = id
+			if err = writeDoQMsg(stream, req); err != nil {
+				return nil, err
+			}
+			stream.Close()
+			return readDoQMsg(stream)
+		}
+
+		for _, name := range []string{"www.example.com.", "www.example.org."} {
+			m, err := query(name, 0)
+			So(err, ShouldBeNil)
+			So(m.Id, ShouldEqual, 0)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].Header().Name, ShouldEqual, name)
+		}
+
+		Convey("and closes the connection on a query with an ID", func() {
+			_, err := query("www.example.com.", 1)
+			So(err, ShouldNotBeNil)
+			<-conn.Context().Done()
+		})
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DumpEntry is the human readable form of a cache entry. TTL is the number
+// of seconds left before the entry expires, negative once it is stale.
+// Failure entries, which carry no message, have the rcode "FAILURE".
+type DumpEntry struct {
+	Cache     string   `json:"cache"`
+	Key       string   `json:"key"`
+	Rcode     string   `json:"rcode"`
+	Answer    []string `json:"answer,omitempty"`
+	Authority []string `json:"authority,omitempty"`
+	TTL       int64    `json:"ttl"`
+	Hits      uint64   `json:"hits"`
+}
+
+// Dump converts the snapshots of the named caches to dump entries, keeping
+// only those selected by p. Entries are sorted by cache and key.
+func Dump(snapshot map[string][]SnapshotEntry, p Purge, now time.Time) []DumpEntry {
+	var entries []DumpEntry
+	for name, ses := range snapshot {
+		for _, se := range ses {
+			if !p.match(se.Key) {
+				continue
+			}
+			entries = append(entries, newDumpEntry(name, se, now))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Cache != entries[j].Cache {
+			return entries[i].Cache < entries[j].Cache
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func newDumpEntry(cache string, se SnapshotEntry, now time.Time) DumpEntry {
+	e := DumpEntry{
+		Cache: cache,
+		Key:   se.Key.String(),
+		Rcode: "FAILURE",
+		TTL:   int64(se.Expire.Sub(now) / time.Second),
+		Hits:  se.Hits,
+	}
+
+	m, err := se.msg()
+	switch {
+	case err != nil:
+		e.Rcode = "INVALID"
+	case m.Msg != nil:
+		e.Rcode = dns.RcodeToString[m.Msg.Rcode]
+		e.Answer = rrStrings(m.Msg.Answer)
+		e.Authority = rrStrings(m.Msg.Ns)
+	}
+	return e
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	var s []string
+	for _, rr := range rrs {
+		s = append(s, rr.String())
+	}
+	return s
+}
+
+// WriteDump writes entries to w, as indented JSON if format is "json" and
+// as text, one line per entry followed by its records, otherwise.
+func WriteDump(w io.Writer, entries []DumpEntry, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(w, "%-8s %s %s ttl=%d hits=%d\n", e.Cache, e.Key, e.Rcode, e.TTL, e.Hits); err != nil {
+			return err
+		}
+		for _, rr := range append(e.Answer, e.Authority...) {
+			if _, err := fmt.Fprintf(w, "\t%s\n", rr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DumpSnapshot writes the entries of the snapshot file at path to w.
+func DumpSnapshot(w io.Writer, path, format string) error {
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	return WriteDump(w, Dump(snapshot, Purge{}, time.Now()), format)
+}
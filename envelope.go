@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The remote cache backends store every entry in an envelope:
+//
+//	version (1 byte) | flags (1 byte) | TTL (4 bytes) | stored at (8 bytes) | packed message
+//
+// TTL is the lifetime the entry was stored with in seconds, stored at the
+// unix time in seconds, both big endian. Entries of the failure cache carry
+// no message and have the nil flag set.
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 14
+
+	envelopeNil = 1 << 0
+)
+
+var errEnvelope = errors.New("invalid cache envelope")
+
+func packEnvelope(msg *dns.Msg, ttl uint32, stored time.Time) ([]byte, error) {
+	var packed []byte
+	var flags byte
+	if msg == nil {
+		flags |= envelopeNil
+	} else {
+		var err error
+		if packed, err = msg.Pack(); err != nil {
+			return nil, SerializerError{err}
+		}
+	}
+
+	b := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(packed))
+	b[0] = envelopeVersion
+	b[1] = flags
+	binary.BigEndian.PutUint32(b[2:], ttl)
+	binary.BigEndian.PutUint64(b[6:], uint64(stored.Unix()))
+	return append(b, packed...), nil
+}
+
+// unpackEnvelope returns the message of an envelope with its TTLs counted
+// down to now, or nil for an entry without message.
+func unpackEnvelope(b []byte, now time.Time) (*dns.Msg, error) {
+	if len(b) < envelopeHeaderSize || b[0] != envelopeVersion {
+		return nil, SerializerError{errEnvelope}
+	}
+	if b[1]&envelopeNil != 0 {
+		return nil, nil
+	}
+
+	ttl := time.Duration(binary.BigEndian.Uint32(b[2:])) * time.Second
+	stored := time.Unix(int64(binary.BigEndian.Uint64(b[6:])), 0)
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b[envelopeHeaderSize:]); err != nil {
+		return nil, SerializerError{err}
+	}
+	return ageMsg(msg, now.Sub(stored), stored.Add(ttl).Sub(now)), nil
+}
+
+// maxRemoteTTL keeps expirations below 30 days, above which memcache takes
+// them for unix timestamps.
+const maxRemoteTTL = 30 * 24 * 3600
+
+// ttlBounds clamps the lifetime of the entries of a remote backend, like
+// CacheConf.MinTTL and MaxTTL do for the memory cache. Zero bounds are
+// ignored.
+type ttlBounds struct {
+	minTTL time.Duration
+	maxTTL time.Duration
+}
+
+func newTTLBounds(cc CacheConf) ttlBounds {
+	return ttlBounds{minTTL: time.Duration(cc.MinTTL) * time.Second, maxTTL: time.Duration(cc.MaxTTL) * time.Second}
+}
+
+// remoteTTL returns the lifetime of msg in a remote backend in seconds: the
+// minimum TTL of its records clamped to b, or expire if it has none.
+func (b ttlBounds) remoteTTL(msg *dns.Msg, expire int64) uint32 {
+	ttl := uint32(expire)
+	if msg != nil {
+		if t, ok := msgTTL(msg); ok {
+			ttl = uint32(clampDuration(time.Duration(t)*time.Second, b.minTTL, b.maxTTL) / time.Second)
+		}
+	}
+	if ttl > maxRemoteTTL {
+		ttl = maxRemoteTTL
+	}
+	return ttl
+}
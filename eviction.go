@@ -0,0 +1,171 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+)
+
+// evictionPolicy picks the entry a full MemoryCache drops to make room.
+// Implementations are safe for concurrent use.
+type evictionPolicy interface {
+	Add(key CacheKey)
+	Touch(key CacheKey)
+	Remove(key CacheKey)
+	Victim() (key CacheKey, ok bool)
+}
+
+// newEvictionPolicy returns the policy for the cache.eviction setting.
+// "none" keeps the legacy behavior of refusing inserts when full.
+func newEvictionPolicy(name string) (evictionPolicy, bool) {
+	switch name {
+	case "", "lru":
+		return newLRUPolicy(), true
+	case "lfu":
+		return newLFUPolicy(), true
+	case "none":
+		return nil, true
+	default:
+		return nil, false
+	}
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+	order *list.List
+	items map[CacheKey]*list.Element
+	mu    sync.Mutex
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), items: make(map[CacheKey]*list.Element)}
+}
+
+func (p *lruPolicy) Add(key CacheKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.items[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.items[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Touch(key CacheKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.items[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key CacheKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.items[key]; ok {
+		p.order.Remove(e)
+		delete(p.items, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (CacheKey, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e := p.order.Back(); e != nil {
+		return e.Value.(CacheKey), true
+	}
+	return CacheKey{}, false
+}
+
+// lfuPolicy evicts the least frequently used entry, the least recently
+// added one among equals. Adding a key again, as refreshes do, keeps its
+// hits.
+type lfuPolicy struct {
+	heap  lfuHeap
+	items map[CacheKey]*lfuItem
+	seq   uint64
+	mu    sync.Mutex
+}
+
+type lfuItem struct {
+	key   CacheKey
+	hits  uint64
+	seq   uint64
+	index int
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{items: make(map[CacheKey]*lfuItem)}
+}
+
+func (p *lfuPolicy) Add(key CacheKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq++
+	if it, ok := p.items[key]; ok {
+		it.seq = p.seq
+		heap.Fix(&p.heap, it.index)
+		return
+	}
+	it := &lfuItem{key: key, seq: p.seq}
+	p.items[key] = it
+	heap.Push(&p.heap, it)
+}
+
+func (p *lfuPolicy) Touch(key CacheKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if it, ok := p.items[key]; ok {
+		it.hits++
+		heap.Fix(&p.heap, it.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(key CacheKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if it, ok := p.items[key]; ok {
+		heap.Remove(&p.heap, it.index)
+		delete(p.items, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (CacheKey, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.heap) == 0 {
+		return CacheKey{}, false
+	}
+	return p.heap[0].key, true
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	it := x.(*lfuItem)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
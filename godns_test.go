@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -11,6 +12,11 @@ const (
 	domain     = "www.sina.com.cn"
 )
 
+func TestMain(m *testing.M) {
+	logger = NewLogger()
+	os.Exit(m.Run())
+}
+
 func BenchmarkDig(b *testing.B) {
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(domain), dns.TypeA)
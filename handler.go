@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -13,6 +17,13 @@ const (
 	_IP6Query  = 6
 )
 
+// Key prefixes of the caches in the remote backends.
+const (
+	cacheKeyPrefix     = "godns:cache:"
+	negCacheKeyPrefix  = "godns:neg:"
+	failCacheKeyPrefix = "godns:fail:"
+)
+
 type Question struct {
 	qname  string
 	qtype  string
@@ -23,61 +34,200 @@ func (q *Question) String() string {
 	return q.qname + " " + q.qclass + " " + q.qtype
 }
 
+// GODNSHandler keeps three caches: cache for positive answers, negCache for
+// NXDOMAIN/NODATA answers (RFC 2308) and failCache for upstream failures.
 type GODNSHandler struct {
-	resolver        *Resolver
-	cache, negCache Cache
-	hosts           Hosts
+	resolver                   *Resolver
+	cache, negCache, failCache Cache
+	hosts                      Hosts
+	invalidator                *Invalidator
+
+	// refreshing holds the keys with a background lookup in flight.
+	refreshing sync.Map
 }
 
 func NewHandler() *GODNSHandler {
-	var cache, negCache Cache
+	var cache, negCache, failCache Cache
 
 	resolver := NewResolver(conf.ResolvConfig)
 
 	cacheConf := conf.Cache
+	negConf := cacheConf
+	negConf.MaxTTL = cacheConf.NegMaxTTL
+	failConf := cacheConf
+	failConf.Expire = cacheConf.Expire / 2
+
 	switch cacheConf.Backend {
 	case "", "memory":
-		cache = &MemoryCache{
-			Backend:  make(map[string]Msg, cacheConf.MaxCount),
-			Expire:   time.Duration(cacheConf.Expire) * time.Second,
-			MaxCount: cacheConf.MaxCount,
-		}
-		negCache = &MemoryCache{
-			Backend:  make(map[string]Msg),
-			Expire:   time.Duration(cacheConf.Expire) * time.Second / 2,
-			MaxCount: cacheConf.MaxCount,
-		}
+		cache = newMemoryBackend(cacheConf)
+		negCache = newMemoryBackend(negConf)
+		failCache = newMemoryBackend(failConf)
 	case "memcache":
-		cache = NewMemcachedCache(conf.Memcache.Servers, int32(cacheConf.Expire))
-		negCache = NewMemcachedCache(conf.Memcache.Servers, int32(cacheConf.Expire/2))
+		cache = NewMemcachedCache(conf.Memcache.Servers, cacheConf, cacheKeyPrefix)
+		negCache = NewMemcachedCache(conf.Memcache.Servers, negConf, negCacheKeyPrefix)
+		failCache = NewMemcachedCache(conf.Memcache.Servers, failConf, failCacheKeyPrefix)
 	case "redis":
-		cache = NewRedisCache(conf.Redis, int64(cacheConf.Expire))
-		negCache = NewRedisCache(conf.Redis, int64(cacheConf.Expire/2))
+		cache = NewRedisCache(conf.Redis, cacheConf, cacheKeyPrefix)
+		negCache = NewRedisCache(conf.Redis, negConf, negCacheKeyPrefix)
+		failCache = NewRedisCache(conf.Redis, failConf, failCacheKeyPrefix)
 	default:
 		logger.Error("Invalid cache backend %s", cacheConf.Backend)
 		panic("Invalid cache backend")
 	}
 
+	// put an in-process L1 cache in front of the remote backends
+	if cacheConf.Backend != "" && cacheConf.Backend != "memory" && cacheConf.L1MaxCount > 0 {
+		cache = NewLayeredCache(newMemoryBackend(cacheConf.l1()), cache)
+
+		negConf := cacheConf.l1()
+		negConf.MaxTTL = minPositive(cacheConf.NegMaxTTL, cacheConf.L1MaxTTL)
+		negCache = NewLayeredCache(newMemoryBackend(negConf), negCache)
+
+		failConf := cacheConf.l1()
+		failConf.Expire = minPositive(cacheConf.Expire/2, cacheConf.L1MaxTTL)
+		failCache = NewLayeredCache(newMemoryBackend(failConf), failCache)
+	}
+
 	var hosts Hosts
 	if conf.Hosts.Enable {
 		hosts = NewHosts(conf.Hosts, conf.Redis)
 	}
 
-	return &GODNSHandler{resolver: resolver, cache: cache, negCache: negCache, hosts: hosts}
+	h := &GODNSHandler{resolver: resolver, cache: cache, negCache: negCache, failCache: failCache, hosts: hosts}
+	if cacheConf.InvalidationChannel != "" {
+		var local []Cache
+		for _, c := range []Cache{cache, negCache, failCache} {
+			if l := localCache(c); l != nil {
+				local = append(local, l)
+			}
+		}
+		h.invalidator = NewInvalidator(conf.Redis, cacheConf.InvalidationChannel, local...)
+		h.invalidator.Run()
+	}
+	if cacheConf.SnapshotFile != "" {
+		h.loadSnapshot(cacheConf.SnapshotFile)
+		if cacheConf.SnapshotInterval > 0 {
+			go h.saveSnapshots(time.Duration(cacheConf.SnapshotInterval) * time.Second)
+		}
+	}
+	return h
+}
+
+// Stats returns the stats of the positive, negative and failure caches.
+func (h *GODNSHandler) Stats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"cache":    h.cache.Stats(),
+		"negative": h.negCache.Stats(),
+		"failure":  h.failCache.Stats(),
+	}
+}
+
+// Flush drops the entries selected by p from every cache and returns their
+// number, or -1 if a backend can't count them. With an invalidation
+// channel, the other instances drop them too. A cache which fails to purge
+// doesn't stop the others, its error is returned along with the number of
+// the entries dropped so far.
+func (h *GODNSHandler) Flush(p Purge) (int, error) {
+	n, counted := 0, true
+	var errs []error
+	caches := []struct {
+		name  string
+		cache Cache
+	}{{"positive", h.cache}, {"negative", h.negCache}, {"failure", h.failCache}}
+	for _, c := range caches {
+		m, err := c.cache.Purge(p)
+		if m < 0 {
+			counted = false
+		} else {
+			n += m
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s cache: %w", c.name, err))
+		}
+	}
+
+	if h.invalidator != nil {
+		if err := h.invalidator.Publish(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if !counted {
+		logger.Info("Flushed cache entries of %q", p.String())
+		return -1, errors.Join(errs...)
+	}
+	logger.Info("Flushed %d cache entries of %q", n, p.String())
+	return n, errors.Join(errs...)
+}
+
+// Dump returns the entries selected by p which the in-process caches hold.
+// Remote backends can't be listed, only their L1 cache if there is one.
+func (h *GODNSHandler) Dump(p Purge) []DumpEntry {
+	caches := map[string]Cache{"cache": h.cache, "negative": h.negCache, "failure": h.failCache}
+	snapshot := make(map[string][]SnapshotEntry, len(caches))
+	for name, c := range caches {
+		if s, ok := localCache(c).(Snapshotter); ok {
+			snapshot[name] = s.Snapshot()
+		}
+	}
+	return Dump(snapshot, p, time.Now())
+}
+
+// snapshotCaches returns the caches kept in the snapshot file, by name.
+func (h *GODNSHandler) snapshotCaches() map[string]Cache {
+	return map[string]Cache{"cache": h.cache, "negative": h.negCache}
+}
+
+func (h *GODNSHandler) loadSnapshot(path string) {
+	n, err := LoadSnapshot(path, h.snapshotCaches())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Load cache snapshot %s failed: %s", path, err)
+		}
+		return
+	}
+	logger.Info("Restored %d cache entries from %s", n, path)
+}
+
+// SaveSnapshot writes the memory caches to the snapshot file, if configured.
+func (h *GODNSHandler) SaveSnapshot() {
+	path := conf.Cache.SnapshotFile
+	if path == "" {
+		return
+	}
+	if err := SaveSnapshot(path, h.snapshotCaches()); err != nil {
+		logger.Warn("Save cache snapshot %s failed: %s", path, err)
+		return
+	}
+	logger.Debug("Saved cache snapshot to %s", path)
+}
+
+func (h *GODNSHandler) saveSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.SaveSnapshot()
+	}
+}
+
+// newMemoryBackend returns a sharded memory cache if more than one shard
+// is configured, a plain one otherwise.
+func newMemoryBackend(cc CacheConf) Cache {
+	if cc.Shards > 1 {
+		return NewShardedMemoryCache(cc)
+	}
+	return NewMemoryCache(cc)
 }
 
 func (h *GODNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
 	q := req.Question[0]
 	Q := Question{qname: UnFqdn(q.Name), qtype: dns.TypeToString[q.Qtype], qclass: dns.ClassToString[q.Qclass]}
 
-	var remote net.IP
-	if Net == "tcp" {
-		remote = w.RemoteAddr().(*net.TCPAddr).IP
-	} else {
-		remote = w.RemoteAddr().(*net.UDPAddr).IP
-	}
+	remote := remoteIP(w.RemoteAddr())
 	logger.Info("%s lookup　%s", remote, Q.String())
 
+	// Lookup may add an OPT record to req, remember whether the client sent one
+	edns := req.IsEdns0() != nil
+
 	IPQuery := h.isIPQuery(q)
 
 	// Query hosts
@@ -119,47 +269,147 @@ func (h *GODNSHandler) do(Net string, w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 
-	key := KeyGen(Q)
+	// Answer the address and local domains of the server list
+	if m := h.resolver.LocalAnswer(req); m != nil {
+		w.WriteMsg(m)
+		logger.Debug("%s answered locally", Q.String())
+		return
+	}
+
+	key := NewCacheKey(req)
 	m, err := h.cache.Get(key)
-	if err != nil {
-		if m, err = h.negCache.Get(key); err != nil {
-			logger.Debug("%s didn't hit cache", Q.String())
-		} else {
-			logger.Debug("%s hit negative cache", Q.String())
-			dns.HandleFailed(w, req)
+	if err == nil {
+		logger.Debug("%s hit cache", Q.String())
+		// the cache hands out a private copy with its TTLs counted down
+		m.Id = req.Id
+		w.WriteMsg(m)
+
+		if p, ok := h.cache.(Prefetcher); ok && p.NeedPrefetch(key) {
+			logger.Debug("%s prefetch", Q.String())
+			h.refresh(Net, key, Q, req)
+		}
+		return
+	}
+
+	if m, err = h.negCache.Get(key); err == nil {
+		logger.Debug("%s hit negative cache", Q.String())
+		m.Id = req.Id
+		w.WriteMsg(m)
+		return
+	}
+
+	if _, err = h.failCache.Get(key); err == nil {
+		logger.Debug("%s hit failure cache", Q.String())
+		if h.serveStale(key, w, req, edns) {
+			h.refresh(Net, key, Q, req)
 			return
 		}
-	} else {
-		logger.Debug("%s hit cache", Q.String())
-		// we need this copy against concurrent modification of Id
-		msg := *m
-		msg.Id = req.Id
-		w.WriteMsg(&msg)
+		dns.HandleFailed(w, req)
 		return
 	}
+	logger.Debug("%s didn't hit cache", Q.String())
 
 	m, err = h.resolver.Lookup(Net, req)
 
 	if err != nil {
 		logger.Warn("Resolve query error %s", err)
-		dns.HandleFailed(w, req)
 
 		// cache the failure, too!
-		if err = h.negCache.Set(key, nil); err != nil {
-			logger.Warn("Set %s negative cache failed: %v", Q.String(), err)
+		if err = h.failCache.Set(key, nil); err != nil {
+			logger.Warn("Set %s failure cache failed: %v", Q.String(), err)
+		}
+
+		if !h.serveStale(key, w, req, edns) {
+			dns.HandleFailed(w, req)
 		}
 		return
 	}
 
 	w.WriteMsg(m)
+	h.store(key, Q, m)
+}
 
-	if len(m.Answer) > 0 {
-		err = h.cache.Set(key, m)
-		if err != nil {
+// store caches an upstream answer in the positive or negative cache.
+func (h *GODNSHandler) store(key CacheKey, Q Question, m *dns.Msg) {
+	switch {
+	case len(m.Answer) > 0:
+		if err := h.cache.Set(key, m); err != nil {
 			logger.Warn("Set %s cache failed: %s", Q.String(), err.Error())
 		}
 		logger.Debug("Insert %s into cache", Q.String())
+	case isNegative(m):
+		if err := h.negCache.Set(key, m); err != nil {
+			logger.Warn("Set %s negative cache failed: %s", Q.String(), err.Error())
+		}
+		logger.Debug("Insert %s into negative cache", Q.String())
+	}
+}
+
+// isNegative reports whether m is a NXDOMAIN or NODATA answer which may be
+// cached. Negative answers without a SOA record must not be cached (RFC 2308).
+func isNegative(m *dns.Msg) bool {
+	if m.Rcode != dns.RcodeNameError && (m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0) {
+		return false
 	}
+	return negativeSOA(m) != nil
+}
+
+// serveStale answers req with an expired cache entry (RFC 8767), if the
+// cache keeps one. It reports whether an answer has been written. The EDE
+// option is only attached if the client's query had an OPT record, edns.
+func (h *GODNSHandler) serveStale(key CacheKey, w dns.ResponseWriter, req *dns.Msg, edns bool) bool {
+	var m *dns.Msg
+	for _, c := range []Cache{h.cache, h.negCache} {
+		if sc, ok := c.(StaleCache); ok {
+			if msg, err := sc.GetStale(key); err == nil {
+				m = msg
+				break
+			}
+		}
+	}
+	if m == nil {
+		return false
+	}
+
+	forEachTTL(m, func(hdr *dns.RR_Header) {
+		hdr.Ttl = uint32(conf.Cache.StaleAnswerTTL)
+	})
+	if conf.Cache.StaleEDE && edns {
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt = m.IsEdns0()
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+
+	logger.Info("%s served stale answer", UnFqdn(req.Question[0].Name))
+	m.Id = req.Id
+	w.WriteMsg(m)
+	return true
+}
+
+// refresh looks req up again in the background and caches the answer,
+// to prefetch popular entries or replace stale ones.
+// Only one refresh per key is in flight at a time.
+func (h *GODNSHandler) refresh(Net string, key CacheKey, Q Question, req *dns.Msg) {
+	if _, loaded := h.refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	go func() {
+		defer h.refreshing.Delete(key)
+
+		m, err := h.resolver.Lookup(Net, req.Copy())
+		if err != nil {
+			logger.Warn("Refresh %s failed: %s", Q.String(), err)
+			if err = h.failCache.Set(key, nil); err != nil {
+				logger.Warn("Set %s failure cache failed: %v", Q.String(), err)
+			}
+			return
+		}
+		h.store(key, Q, m)
+	}()
 }
 
 func (h *GODNSHandler) DoTCP(w dns.ResponseWriter, req *dns.Msg) {
@@ -170,6 +420,40 @@ func (h *GODNSHandler) DoUDP(w dns.ResponseWriter, req *dns.Msg) {
 	h.do("udp", w, req)
 }
 
+// DoTLS serves DNS-over-TLS queries, which are resolved upstream over tcp.
+func (h *GODNSHandler) DoTLS(w dns.ResponseWriter, req *dns.Msg) {
+	h.do("tcp", w, req)
+}
+
+// DoHTTPS serves DNS-over-HTTPS queries, which are resolved upstream over
+// tcp since HTTP responses aren't size limited.
+func (h *GODNSHandler) DoHTTPS(w dns.ResponseWriter, req *dns.Msg) {
+	h.do("tcp", w, req)
+}
+
+// DoQUIC serves DNS-over-QUIC queries, which are resolved upstream over tcp.
+func (h *GODNSHandler) DoQUIC(w dns.ResponseWriter, req *dns.Msg) {
+	h.do("tcp", w, req)
+}
+
+// remoteIP returns the IP of a client address, whatever the transport.
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
 func (h *GODNSHandler) isIPQuery(q dns.Question) int {
 	if q.Qclass != dns.ClassINET {
 		return notIPQuery
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHandlerNegativeCache(t *testing.T) {
+	Convey("NXDOMAIN and NODATA answers are cached for the TTL of their SOA", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 30)
+		h := newTestHandler(t, upstream.addr)
+		neg := h.negCache.(*MemoryCache)
+
+		nodata := new(dns.Msg)
+		nodata.SetQuestion("www.example.com.", dns.TypeAAAA)
+		nx := new(dns.Msg)
+		nx.SetQuestion("nx.example.com.", dns.TypeA)
+
+		m := ask(h, nodata.Copy())
+		So(m.Rcode, ShouldEqual, dns.RcodeSuccess)
+		So(m.Answer, ShouldBeEmpty)
+		upstream.rcode.Store(dns.RcodeNameError)
+		m = ask(h, nx.Copy())
+		So(m.Rcode, ShouldEqual, dns.RcodeNameError)
+		So(upstream.queries.Load(), ShouldEqual, 2)
+
+		for _, req := range []*dns.Msg{nodata, nx} {
+			neg.mu.RLock()
+			e, ok := neg.Backend[NewCacheKey(req)]
+			neg.mu.RUnlock()
+			So(ok, ShouldBeTrue)
+			So(e.Expire.Sub(e.Stored), ShouldEqual, 30*time.Second)
+			So(h.cache.Exists(NewCacheKey(req)), ShouldBeFalse)
+		}
+
+		upstream.rcode.Store(dns.RcodeSuccess)
+		for rcode, req := range map[int]*dns.Msg{dns.RcodeSuccess: nodata, dns.RcodeNameError: nx} {
+			req.Id = dns.Id()
+			m = ask(h, req.Copy())
+			So(m.Id, ShouldEqual, req.Id)
+			So(m.Rcode, ShouldEqual, rcode)
+			So(m.Answer, ShouldBeEmpty)
+			So(m.Ns, ShouldHaveLength, 1)
+			So(m.Ns[0].(*dns.SOA).Hdr.Name, ShouldEqual, "example.")
+			So(m.Ns[0].Header().Ttl, ShouldBeBetweenOrEqual, 29, 30)
+		}
+		So(upstream.queries.Load(), ShouldEqual, 2)
+	})
+}
+
+func TestHandlerServeStale(t *testing.T) {
+	Convey("Expired answers are served stale when every upstream fails", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 60)
+		h := newTestHandler(t, upstream.addr)
+		h.cache = NewMemoryCache(CacheConf{Expire: 600, StaleTTL: 3600})
+		conf.Cache.StaleAnswerTTL = 30
+		conf.Cache.StaleEDE = true
+		conf.ResolvConfig.SetEDNS0 = true
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		So(ask(h, req.Copy()).Answer, ShouldHaveLength, 1)
+		c := h.cache.(*MemoryCache)
+		c.mu.Lock()
+		e := c.Backend[NewCacheKey(req)]
+		e.Stored, e.Expire = e.Stored.Add(-120*time.Second), e.Expire.Add(-120*time.Second)
+		c.mu.Unlock()
+		upstream.rcode.Store(dns.RcodeServerFailure)
+
+		Convey("with the stale answer TTL and EDE 3 to EDNS clients", func() {
+			edns := req.Copy()
+			edns.SetEdns0(1232, false)
+			m := ask(h, edns)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].Header().Ttl, ShouldEqual, 30)
+			opt := m.IsEdns0()
+			So(opt, ShouldNotBeNil)
+			So(opt.Option, ShouldHaveLength, 1)
+			So(opt.Option[0].(*dns.EDNS0_EDE).InfoCode, ShouldEqual, dns.ExtendedErrorCodeStaleAnswer)
+		})
+
+		Convey("without an OPT record to clients which sent none", func() {
+			m := ask(h, req.Copy())
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].Header().Ttl, ShouldEqual, 30)
+			So(m.IsEdns0(), ShouldBeNil)
+		})
+
+		Convey("refreshing them once for concurrent hits", func() {
+			So(ask(h, req.Copy()).Answer, ShouldHaveLength, 1)
+			queries := upstream.queries.Load()
+			upstream.rcode.Store(dns.RcodeSuccess)
+			upstream.delay.Store(int64(200 * time.Millisecond))
+
+			ttls := make(chan uint32, 10)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if m := ask(h, req.Copy()); m != nil && len(m.Answer) == 1 {
+						ttls <- m.Answer[0].Header().Ttl
+					}
+				}()
+			}
+			wg.Wait()
+			close(ttls)
+			n := 0
+			for ttl := range ttls {
+				So(ttl, ShouldEqual, 30)
+				n++
+			}
+			So(n, ShouldEqual, 10)
+
+			waitRefreshes(h)
+			So(upstream.queries.Load()-queries, ShouldEqual, 1)
+			m := ask(h, req.Copy())
+			So(m.Answer[0].Header().Ttl, ShouldBeBetweenOrEqual, 59, 60)
+		})
+	})
+}
+
+func TestHandlerPrefetch(t *testing.T) {
+	Convey("Popular entries close to expiry are prefetched once", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 100)
+		h := newTestHandler(t, upstream.addr)
+		c := NewMemoryCache(CacheConf{Expire: 600, Prefetch: 10, PrefetchHits: 2})
+		h.cache = c
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		So(ask(h, req.Copy()).Answer, ShouldHaveLength, 1)
+		So(upstream.queries.Load(), ShouldEqual, 1)
+		c.mu.Lock()
+		e := c.Backend[NewCacheKey(req)]
+		e.Stored, e.Expire = e.Stored.Add(-95*time.Second), e.Expire.Add(-95*time.Second)
+		c.mu.Unlock()
+
+		upstream.delay.Store(int64(200 * time.Millisecond))
+		for i := 0; i < 5; i++ {
+			m := ask(h, req.Copy())
+			So(m.Answer, ShouldHaveLength, 1)
+			So(m.Answer[0].Header().Ttl, ShouldBeLessThanOrEqualTo, 5)
+		}
+		waitRefreshes(h)
+		So(upstream.queries.Load(), ShouldEqual, 2)
+
+		c.mu.RLock()
+		refreshed := c.Backend[NewCacheKey(req)]
+		c.mu.RUnlock()
+		So(refreshed, ShouldNotEqual, e)
+		So(time.Until(refreshed.Expire), ShouldBeGreaterThan, 90*time.Second)
+		m := ask(h, req.Copy())
+		So(m.Answer[0].Header().Ttl, ShouldBeBetweenOrEqual, 99, 100)
+		So(upstream.queries.Load(), ShouldEqual, 2)
+	})
+}
+
+// waitRefreshes waits for the background lookups of h to finish.
+func waitRefreshes(h *GODNSHandler) {
+	for i := 0; i < 200; i++ {
+		busy := false
+		h.refreshing.Range(func(_, _ interface{}) bool {
+			busy = true
+			return false
+		})
+		if !busy {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
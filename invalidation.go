@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoisie/redis"
+)
+
+const invalidationRetry = 5 * time.Second
+
+// Invalidator spreads cache purges between godns instances over a redis
+// pub/sub channel. Every instance applies the purges it receives to its
+// in-process caches, including the purges it published itself. Shared
+// remote caches are purged once by the publisher.
+type Invalidator struct {
+	rs      RedisConf
+	redis   *redis.Client
+	channel string
+	caches  []Cache
+}
+
+func NewInvalidator(rs RedisConf, channel string, caches ...Cache) *Invalidator {
+	return &Invalidator{
+		rs:      rs,
+		redis:   &redis.Client{Addr: rs.Addr(), Db: rs.DB, Password: rs.Password},
+		channel: channel,
+		caches:  caches,
+	}
+}
+
+// Publish sends p to every instance listening on the channel.
+func (i *Invalidator) Publish(p Purge) error {
+	return i.redis.Publish(i.channel, []byte(p.String()))
+}
+
+// Run listens on the channel in the background, resubscribing whenever
+// the connection to redis is lost.
+func (i *Invalidator) Run() {
+	go func() {
+		for {
+			err := i.subscribe()
+			logger.Warn("Cache invalidation channel %s lost: %v", i.channel, err)
+			time.Sleep(invalidationRetry)
+		}
+	}()
+}
+
+// subscribe applies the purges published on the channel until the
+// connection fails. It talks to redis directly, as hoisie/redis panics
+// in Subscribe when redis is unreachable.
+func (i *Invalidator) subscribe() error {
+	conn, err := net.DialTimeout("tcp", i.rs.Addr(), invalidationRetry)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	if i.rs.Password != "" {
+		if err = writeRedisCommand(conn, "AUTH", i.rs.Password); err != nil {
+			return err
+		}
+		if _, err = readRedisReply(r); err != nil {
+			return err
+		}
+	}
+	if err = writeRedisCommand(conn, "SUBSCRIBE", i.channel); err != nil {
+		return err
+	}
+	logger.Info("Subscribed to cache invalidation channel %s", i.channel)
+
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return err
+		}
+		if len(reply) == 3 && reply[0] == "message" {
+			i.apply(reply[2])
+		}
+	}
+}
+
+func (i *Invalidator) apply(msg string) {
+	p, err := ParsePurge(msg)
+	if err != nil {
+		logger.Warn("Ignore cache invalidation: %s", err)
+		return
+	}
+
+	n := 0
+	for _, c := range i.caches {
+		m, _ := c.Purge(p)
+		n += m
+	}
+	logger.Info("Cache invalidation %q dropped %d entries", p.String(), n)
+}
+
+func writeRedisCommand(w io.Writer, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readRedisReply reads a reply as a list of strings: the elements of an
+// array, or the single value of any other reply.
+func readRedisReply(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return []string{line[1:]}, nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return []string{string(buf[:size])}, nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		var reply []string
+		for j := 0; j < n; j++ {
+			elem, err := readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+			reply = append(reply, elem...)
+		}
+		return reply, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 const LogOutputBuffer = 1024
@@ -19,6 +20,8 @@ const (
 type logMsg struct {
 	Level int
 	Msg   string
+	// flushed is closed once the messages before it are written.
+	flushed chan struct{}
 }
 
 type LoggerHandler interface {
@@ -64,6 +67,10 @@ func (l *GoDNSLogger) Run() {
 	for {
 		select {
 		case m := <-l.msgChan:
+			if m.flushed != nil {
+				close(m.flushed)
+				continue
+			}
 			for _, handler := range l.outputs {
 				handler.Write(m)
 			}
@@ -84,6 +91,21 @@ func (l *GoDNSLogger) writeMsg(msg string, level int) {
 	l.msgChan <- lm
 }
 
+// Flush waits until the messages logged so far are written, or timeout
+// passes.
+func (l *GoDNSLogger) Flush(timeout time.Duration) {
+	flushed := make(chan struct{})
+	select {
+	case l.msgChan <- &logMsg{flushed: flushed}:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+	}
+}
+
 func (l *GoDNSLogger) Debug(format string, v ...interface{}) {
 	m := fmt.Sprintf("[DEBUG] "+format, v...)
 	l.writeMsg(m, LevelDebug)
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"syscall"
 	"time"
 
 	"github.com/bingoohuang/gg/pkg/v"
@@ -18,8 +20,17 @@ var logger *GoDNSLogger
 func main() {
 	configFile := flag.String("c", "./etc/godns.toml", "Look for godns toml-formatting config file in this directory")
 	verbose := flag.Bool("v", false, "verbose output")
+	dump := flag.String("dump", "", "print the entries of this cache snapshot file and exit")
+	dumpFormat := flag.String("dump-format", "text", "format of -dump, text or json")
 	flag.Parse()
 
+	if *dump != "" {
+		if err := DumpSnapshot(os.Stdout, *dump, *dumpFormat); err != nil {
+			log.Fatalf("dump %s failed: %+v", *dump, err)
+		}
+		return
+	}
+
 	if _, err := toml.DecodeFile(*configFile, &conf); err != nil {
 		log.Fatalf("%s is not a valid toml config file, error: %+v", *configFile, err)
 	}
@@ -34,13 +45,13 @@ func main() {
 		logger.Info("godns version: %s", v.Version())
 	}
 
-	server := &Server{
-		listen:   conf.Server.Listen,
-		rTimeout: 5 * time.Second,
-		wTimeout: 5 * time.Second,
-	}
+	server := &Server{}
 
-	server.Run()
+	if err := server.Start(); err != nil {
+		logger.Error("godns start failed: %s", err)
+		logger.Flush(time.Second)
+		os.Exit(1)
+	}
 
 	logger.Info("godns start")
 
@@ -49,13 +60,44 @@ func main() {
 		go profileMEM()
 	}
 
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	code := 0
+loop:
+	for {
+		select {
+		case <-hup:
+			logger.Info("SIGHUP received, reloading")
+			if err := server.Reload(); err != nil {
+				logger.Warn("Reload failed, keeping the current upstreams: %s", err)
+			}
+		case s := <-sig:
+			logger.Info("signal %s received, stopping", s)
+			break loop
+		case err := <-server.Errors():
+			logger.Error("%s, stopping", err)
+			code = 1
+			break loop
+		}
+	}
 
-	<-sig
-	logger.Info("signal received, stopping")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("godns shutdown failed: %s", err)
+		code = 1
+	}
+	cancel()
+	logger.Info("godns stopped")
+	logger.Flush(time.Second)
+	os.Exit(code)
 }
 
+// shutdownTimeout bounds how long queries in flight are waited for.
+const shutdownTimeout = 10 * time.Second
+
 func profileCPU() {
 	f, err := os.Create("godns.cprof")
 	if err != nil {
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Purge selects the cache entries to drop: those of Name, restricted to
+// Qtype if set, or of every name under Name if Suffix is set. A Purge
+// without Name selects every entry.
+type Purge struct {
+	Name   string
+	Qtype  uint16
+	Suffix bool
+}
+
+var errPurgeUnsupported = errors.New("purge not supported by this cache backend")
+
+// ParsePurge parses the text form of a purge, as returned by Purge.String:
+//
+//	all
+//	name www.example.com [A]
+//	suffix example.com
+func ParsePurge(s string) (Purge, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Purge{}, fmt.Errorf("empty purge")
+	}
+
+	switch {
+	case fields[0] == "all" && len(fields) == 1:
+		return Purge{}, nil
+	case fields[0] == "suffix" && len(fields) == 2:
+		return Purge{Name: purgeName(fields[1]), Suffix: true}, nil
+	case fields[0] == "name" && len(fields) == 2:
+		return Purge{Name: purgeName(fields[1])}, nil
+	case fields[0] == "name" && len(fields) == 3:
+		qtype, ok := dns.StringToType[strings.ToUpper(fields[2])]
+		if !ok {
+			return Purge{}, fmt.Errorf("unknown type %s in purge %q", fields[2], s)
+		}
+		return Purge{Name: purgeName(fields[1]), Qtype: qtype}, nil
+	default:
+		return Purge{}, fmt.Errorf("invalid purge %q", s)
+	}
+}
+
+func purgeName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+func (p Purge) String() string {
+	switch {
+	case p.Name == "":
+		return "all"
+	case p.Suffix:
+		return "suffix " + p.Name
+	case p.Qtype != 0:
+		return "name " + p.Name + " " + typeString(p.Qtype)
+	default:
+		return "name " + p.Name
+	}
+}
+
+func (p Purge) match(k CacheKey) bool {
+	switch {
+	case p.Name == "":
+		return true
+	case p.Suffix:
+		return k.Name == p.Name || strings.HasSuffix(k.Name, "."+p.Name)
+	default:
+		return k.Name == p.Name && (p.Qtype == 0 || k.Qtype == p.Qtype)
+	}
+}
+
+// ParsePurgeQuery builds a purge from the parameters of an admin request:
+// all, name with an optional type, or suffix.
+func ParsePurgeQuery(all bool, name, qtype, suffix string) (Purge, error) {
+	switch {
+	case all && name == "" && suffix == "":
+		return ParsePurge("all")
+	case suffix != "" && name == "":
+		return ParsePurge("suffix " + suffix)
+	case name != "" && suffix == "":
+		return ParsePurge(strings.TrimSpace("name " + name + " " + qtype))
+	default:
+		return Purge{}, fmt.Errorf("purge needs exactly one of all, name or suffix")
+	}
+}
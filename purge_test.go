@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPurge(t *testing.T) {
+	Convey("Purges parse from and format to text", t, func() {
+		for _, s := range []string{"all", "name www.example.com.", "name www.example.com. AAAA", "suffix example.com."} {
+			p, err := ParsePurge(s)
+			So(err, ShouldBeNil)
+			So(p.String(), ShouldEqual, s)
+		}
+
+		p, err := ParsePurge("name WWW.Example.com a")
+		So(err, ShouldBeNil)
+		So(p, ShouldResemble, Purge{Name: "www.example.com.", Qtype: dns.TypeA})
+
+		for _, s := range []string{"", "everything", "name", "name a.com NOTATYPE", "suffix a.com b.com"} {
+			_, err = ParsePurge(s)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Purges select cache entries", t, func() {
+		c := NewMemoryCache(CacheConf{Expire: 600})
+		aaaa := testKey("www.example.com")
+		aaaa.Qtype = dns.TypeAAAA
+		for _, k := range []CacheKey{testKey("www.example.com"), aaaa, testKey("example.com"), testKey("notexample.com")} {
+			So(c.Set(k, newTestMsg(k.Name, 60)), ShouldBeNil)
+		}
+
+		n, _ := c.Purge(Purge{Name: "www.example.com.", Qtype: dns.TypeAAAA})
+		So(n, ShouldEqual, 1)
+		So(c.Exists(testKey("www.example.com")), ShouldBeTrue)
+
+		n, _ = c.Purge(Purge{Name: "example.com.", Suffix: true})
+		So(n, ShouldEqual, 2)
+		So(c.Exists(testKey("notexample.com")), ShouldBeTrue)
+
+		n, _ = c.Purge(Purge{})
+		So(n, ShouldEqual, 1)
+		So(c.Length(), ShouldEqual, 0)
+	})
+}
+
+func TestInvalidator(t *testing.T) {
+	Convey("Purges published on redis reach every instance", t, func() {
+		standin := newRedisStandin(t)
+		node1 := NewMemoryCache(CacheConf{Expire: 600})
+		node2 := NewShardedMemoryCache(CacheConf{Expire: 600, Shards: 4})
+		for _, c := range []Cache{node1, node2} {
+			So(c.Set(testKey("www.example.com"), newTestMsg("www.example.com", 60)), ShouldBeNil)
+			So(c.Set(testKey("www.other.com"), newTestMsg("www.other.com", 60)), ShouldBeNil)
+		}
+
+		inv1 := NewInvalidator(standin.conf(), "godns:invalidate", node1)
+		inv2 := NewInvalidator(standin.conf(), "godns:invalidate", node2)
+		inv1.Run()
+		inv2.Run()
+		for standin.subscriberCount("godns:invalidate") < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		So(inv1.Publish(Purge{Name: "example.com.", Suffix: true}), ShouldBeNil)
+		deadline := time.Now().Add(time.Second)
+		for (node1.Exists(testKey("www.example.com")) || node2.Exists(testKey("www.example.com"))) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		So(node1.Exists(testKey("www.example.com")), ShouldBeFalse)
+		So(node2.Exists(testKey("www.example.com")), ShouldBeFalse)
+		So(node1.Exists(testKey("www.other.com")), ShouldBeTrue)
+		So(node2.Exists(testKey("www.other.com")), ShouldBeTrue)
+	})
+}
+
+func TestRemotePurge(t *testing.T) {
+	Convey("Redis purges entries by name, suffix and type", t, func() {
+		standin := newRedisStandin(t)
+		c := NewRedisCache(standin.conf(), CacheConf{Expire: 300}, "godns:test:")
+		aaaa := testKey("www.example.com")
+		aaaa.Qtype = dns.TypeAAAA
+		for _, k := range []CacheKey{testKey("www.example.com"), aaaa, testKey("example.com"), testKey("notexample.com")} {
+			So(c.Set(k, newTestMsg(k.Name, 60)), ShouldBeNil)
+		}
+
+		n, err := c.Purge(Purge{Name: "www.example.com.", Qtype: dns.TypeAAAA})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+		So(c.Exists(testKey("www.example.com")), ShouldBeTrue)
+
+		n, err = c.Purge(Purge{Name: "example.com.", Suffix: true})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(c.Exists(testKey("notexample.com")), ShouldBeTrue)
+
+		n, err = c.Purge(Purge{})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1)
+	})
+
+	Convey("Memcache purges what it can compute keys for", t, func() {
+		standin := newMemcacheStandin(t)
+		c := NewMemcachedCache([]string{standin.addr}, CacheConf{Expire: 300}, "godns:test:")
+		do := testKey("www.example.com")
+		do.DO = true
+		So(c.Set(testKey("www.example.com"), newTestMsg("www.example.com", 60)), ShouldBeNil)
+		So(c.Set(do, newTestMsg("www.example.com", 60)), ShouldBeNil)
+		So(c.Set(testKey("other.com"), newTestMsg("other.com", 60)), ShouldBeNil)
+
+		n, err := c.Purge(Purge{Name: "www.example.com.", Qtype: dns.TypeA})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(c.Exists(do), ShouldBeFalse)
+
+		aaaa := testKey("www.example.com")
+		aaaa.Qtype, aaaa.CD = dns.TypeAAAA, true
+		So(c.Set(testKey("www.example.com"), newTestMsg("www.example.com", 60)), ShouldBeNil)
+		So(c.Set(aaaa, newTestMsg("www.example.com", 60)), ShouldBeNil)
+		n, err = c.Purge(Purge{Name: "www.example.com."})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 2)
+		So(c.Exists(aaaa), ShouldBeFalse)
+
+		_, err = c.Purge(Purge{Name: "example.com.", Suffix: true})
+		So(err, ShouldEqual, errPurgeUnsupported)
+
+		Convey("and a handler flushes its other caches all the same", func() {
+			h := newTestHandler(t)
+			h.cache = c
+			So(h.negCache.Set(testKey("www.example.com"), newTestMsg("www.example.com")), ShouldBeNil)
+
+			n, err := h.Flush(Purge{Name: "example.com.", Suffix: true})
+			So(errors.Is(err, errPurgeUnsupported), ShouldBeTrue)
+			So(n, ShouldEqual, 1)
+			So(h.negCache.Exists(testKey("www.example.com")), ShouldBeFalse)
+		})
+
+		Convey("but can't count a flush of everything", func() {
+			l1 := NewMemoryCache(CacheConf{Expire: 600})
+			So(l1.Set(testKey("www.example.com"), newTestMsg("www.example.com", 60)), ShouldBeNil)
+			h := newTestHandler(t)
+			h.cache = NewLayeredCache(l1, c)
+
+			n, err := h.Flush(Purge{})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, -1)
+			So(l1.Length(), ShouldEqual, 0)
+		})
+
+		_, err = c.Purge(Purge{})
+		So(err, ShouldBeNil)
+		So(c.Exists(testKey("other.com")), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultReloadInterval is how often the server-list and resolv files are
+// checked for changes, see ResolvConf.ReloadInterval.
+const defaultReloadInterval = 10 * time.Second
+
+// routes is where the server-list and resolv files send queries: the
+// default upstreams and the dnsmasq directives of domains. A reload builds
+// new routes off to the side and swaps them in whole.
+type routes struct {
+	servers       []*Upstream
+	domainServer  *suffixTreeNode
+	domainAddress *suffixTreeNode
+	bogus         []*net.IPNet
+}
+
+func newRoutes() *routes {
+	return &routes{domainServer: newSuffixTreeRoot(), domainAddress: newSuffixTreeRoot()}
+}
+
+// loadRoutes reads the server-list and resolv files. Invalid lines are
+// skipped with a warning, at startup and on reload alike; files which
+// can't be read fail.
+func (r *Resolver) loadRoutes() (*routes, error) {
+	rt := newRoutes()
+
+	if r.config.ServerListFile != "" {
+		for _, file := range strings.Split(r.config.ServerListFile, ";") {
+			buf, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			err = r.parseServerListFile(rt, buf)
+			buf.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if r.config.ResolvFile != "" {
+		clientConfig, err := dns.ClientConfigFromFile(r.config.ResolvFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a valid resolv.conf file: %w", r.config.ResolvFile, err)
+		}
+		for _, server := range clientConfig.Servers {
+			u, err := r.upstreams.get(server + "#" + clientConfig.Port)
+			if err != nil {
+				logger.Warn("Skip nameserver %s: %s", server, err)
+				continue
+			}
+			rt.servers = append(rt.servers, u)
+		}
+	}
+
+	return rt, nil
+}
+
+func (r *Resolver) parseServerListFile(rt *routes, buf *os.File) error {
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := r.parseDirective(rt, line); err != nil {
+			logger.Warn("Skip %s: %s", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", buf.Name(), err)
+	}
+	return nil
+}
+
+// Reload reads the server-list and resolv files again and swaps the new
+// routes in. Invalid lines are skipped as at startup; if a file can't be
+// read or no default upstream is left, the current routes are kept.
+// Queries in flight finish on the routes they started with.
+func (r *Resolver) Reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	rt, err := r.loadRoutes()
+	if err != nil {
+		return err
+	}
+	if len(rt.servers) == 0 && len(r.routes.Load().servers) > 0 {
+		return errors.New("no default upstream left")
+	}
+
+	r.routes.Store(rt)
+	r.upstreams.retain(rt.specs())
+	logger.Info("Reloaded %d default upstreams", len(rt.servers))
+	return nil
+}
+
+// files returns the files the routes are read from.
+func (r *Resolver) files() []string {
+	var files []string
+	if r.config.ServerListFile != "" {
+		files = append(files, strings.Split(r.config.ServerListFile, ";")...)
+	}
+	if r.config.ResolvFile != "" {
+		files = append(files, r.config.ResolvFile)
+	}
+	return files
+}
+
+// watch reloads the routes whenever one of their files changes.
+func (r *Resolver) watch() {
+	interval := time.Duration(r.config.ReloadInterval) * time.Second
+	if r.config.ReloadInterval == 0 {
+		interval = defaultReloadInterval
+	}
+	files := r.files()
+	if interval <= 0 || len(files) == 0 {
+		return
+	}
+
+	seen := modTimes(files)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			current := modTimes(files)
+			if equalTimes(current, seen) {
+				continue
+			}
+			seen = current
+			if err := r.Reload(); err != nil {
+				logger.Warn("Reload %s failed, keeping the current upstreams: %s", strings.Join(files, ";"), err)
+			}
+		}
+	}()
+}
+
+// modTimes returns the modification time of every file, zero for missing
+// ones.
+func modTimes(files []string) []time.Time {
+	times := make([]time.Time, len(files))
+	for i, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			times[i] = fi.ModTime()
+		}
+	}
+	return times
+}
+
+func equalTimes(a, b []time.Time) bool {
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+// specs returns the specs of every upstream of rt.
+func (rt *routes) specs() map[string]bool {
+	specs := make(map[string]bool)
+	for _, u := range rt.servers {
+		specs[u.spec] = true
+	}
+	var walk func(node *suffixTreeNode)
+	walk = func(node *suffixTreeNode) {
+		for _, v := range node.values {
+			specs[v] = true
+		}
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(rt.domainServer)
+	return specs
+}
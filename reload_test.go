@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReload(t *testing.T) {
+	Convey("Changed server-list files are swapped in, broken ones are not", t, func() {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "servers.conf")
+		write := func(content string) {
+			So(os.WriteFile(file, []byte(content), 0o644), ShouldBeNil)
+		}
+		names := func(r *Resolver, qname string) []string {
+			var ss []string
+			for _, u := range r.Nameservers(qname) {
+				ss = append(ss, u.String())
+			}
+			return ss
+		}
+
+		write("server=192.0.2.53\nserver=/corp.example/10.0.0.1\n")
+		r := NewResolver(ResolvConf{ServerListFile: file, ReloadInterval: -1})
+		So(names(r, "git.corp.example."), ShouldResemble, []string{"10.0.0.1:53"})
+
+		write("server=192.0.2.53\nserver=/corp.example/10.0.0.2\nserver=/lan/10.0.0.3\n")
+		So(r.Reload(), ShouldBeNil)
+		So(names(r, "git.corp.example."), ShouldResemble, []string{"10.0.0.2:53"})
+		So(names(r, "host.lan."), ShouldResemble, []string{"10.0.0.3:53"})
+
+		// The upstream which is gone isn't reported any more.
+		var reported []string
+		for _, s := range r.UpstreamStatus() {
+			reported = append(reported, s.Upstream)
+		}
+		So(reported, ShouldNotContain, "10.0.0.1:53")
+
+		write("server=/corp.example/10.0.0.4\n")
+		So(r.Reload(), ShouldNotBeNil)
+		So(os.Remove(file), ShouldBeNil)
+		So(r.Reload(), ShouldNotBeNil)
+		So(names(r, "git.corp.example."), ShouldResemble, []string{"10.0.0.2:53"})
+	})
+
+	Convey("Invalid lines are skipped on reload as at startup", t, func() {
+		file := filepath.Join(t.TempDir(), "servers.conf")
+		bad := "server=/bad domain/10.0.0.9\n"
+		So(os.WriteFile(file, []byte(bad+"server=192.0.2.53\nserver=/corp.example/10.0.0.1\n"), 0o644), ShouldBeNil)
+		r := NewResolver(ResolvConf{ServerListFile: file, ReloadInterval: -1})
+		So(r.Nameservers("git.corp.example.")[0].String(), ShouldEqual, "10.0.0.1:53")
+
+		So(os.WriteFile(file, []byte(bad+"server=192.0.2.53\nserver=/corp.example/10.0.0.2\n"), 0o644), ShouldBeNil)
+		So(r.Reload(), ShouldBeNil)
+		So(r.Nameservers("git.corp.example.")[0].String(), ShouldEqual, "10.0.0.2:53")
+	})
+
+	Convey("Server-list files are watched", t, func() {
+		file := filepath.Join(t.TempDir(), "servers.conf")
+		So(os.WriteFile(file, []byte("server=192.0.2.53\n"), 0o644), ShouldBeNil)
+		r := NewResolver(ResolvConf{ServerListFile: file, ReloadInterval: 1})
+
+		So(os.WriteFile(file, []byte("server=192.0.2.54\n"), 0o644), ShouldBeNil)
+		later := time.Now().Add(time.Minute)
+		So(os.Chtimes(file, later, later), ShouldBeNil)
+
+		for i := 0; i < 30 && r.Nameservers("www.example.com.")[0].String() != "192.0.2.54:53"; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		So(r.Nameservers("www.example.com.")[0].String(), ShouldEqual, "192.0.2.54:53")
+	})
+}
@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"net"
-	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -25,102 +22,44 @@ func (e ResolvError) Error() string {
 
 type RResp struct {
 	msg        *dns.Msg
-	nameserver string
+	nameserver *Upstream
 	rtt        time.Duration
 }
 
 type Resolver struct {
-	servers      []string
-	domainServer *suffixTreeNode
-	config       *ResolvConf
+	// routes is swapped whole when the files change, under reloadMu.
+	routes    atomic.Pointer[routes]
+	reloadMu  sync.Mutex
+	upstreams upstreams
+	config    *ResolvConf
+
+	// rounds holds the round-robin position of each upstream group.
+	rounds sync.Map
 }
 
 func NewResolver(c ResolvConf) *Resolver {
-	r := &Resolver{
-		domainServer: newSuffixTreeRoot(),
-		config:       &c,
-	}
+	r := &Resolver{config: &c}
 
-	if c.ServerListFile != "" {
-		r.ReadServerListFile(c.ServerListFile)
+	if !validStrategy(c.Strategy) {
+		logger.Error("Invalid upstream strategy %s", c.Strategy)
+		panic("Invalid upstream strategy")
 	}
-
-	if c.ResolvFile != "" {
-		clientConfig, err := dns.ClientConfigFromFile(c.ResolvFile)
-		if err != nil {
-			logger.Error(":%s is not a valid resolv.conf file\n", c.ResolvFile)
-			logger.Error("%s", err)
-			panic(err)
-		}
-		for _, server := range clientConfig.Servers {
-			nameserver := net.JoinHostPort(server, clientConfig.Port)
-			r.servers = append(r.servers, nameserver)
+	for domain, s := range c.Strategies {
+		if !validStrategy(s) {
+			logger.Error("Invalid upstream strategy %s for %s", s, domain)
+			panic("Invalid upstream strategy")
 		}
 	}
 
-	return r
-}
-
-func (r *Resolver) parseServerListFile(buf *os.File) {
-	scanner := bufio.NewScanner(buf)
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
-
-		if !strings.HasPrefix(line, "server") {
-			continue
-		}
-
-		sli := strings.Split(line, "=")
-		if len(sli) != 2 {
-			continue
-		}
-
-		line = strings.TrimSpace(sli[1])
-
-		tokens := strings.Split(line, "/")
-		switch len(tokens) {
-		case 3:
-			domain := tokens[1]
-			ip := tokens[2]
-
-			if !isDomain(domain) || !isIP(ip) {
-				continue
-			}
-			r.domainServer.sinsert(strings.Split(domain, "."), ip)
-		case 1:
-			srvPort := strings.Split(line, "#")
-			if len(srvPort) > 2 {
-				continue
-			}
-
-			ip := ""
-			if ip = srvPort[0]; !isIP(ip) {
-				continue
-			}
-
-			port := "53"
-			if len(srvPort) == 2 {
-				if _, err := strconv.Atoi(srvPort[1]); err != nil {
-					continue
-				}
-				port = srvPort[1]
-			}
-			r.servers = append(r.servers, net.JoinHostPort(ip, port))
-		}
+	rt, err := r.loadRoutes()
+	if err != nil {
+		logger.Error("%s", err)
+		panic(err)
 	}
-}
+	r.routes.Store(rt)
+	r.watch()
 
-func (r *Resolver) ReadServerListFile(path string) {
-	files := strings.Split(path, ";")
-	for _, file := range files {
-		buf, err := os.Open(file)
-		if err != nil {
-			panic("Can't open " + file)
-		}
-		defer buf.Close()
-		r.parseServerListFile(buf)
-	}
+	return r
 }
 
 // Lookup will ask each nameserver in top-to-bottom fashion, starting a new request
@@ -139,11 +78,17 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error
 
 	qname := req.Question[0].Name
 
+	maxFails, failTimeout := r.healthConf()
 	res := make(chan *RResp, 1)
 	var wg sync.WaitGroup
-	L := func(nameserver string) {
+	L := func(nameserver *Upstream) {
 		defer wg.Done()
-		r, rtt, err := c.Exchange(req, nameserver)
+		m, rtt, err := nameserver.Exchange(c, req)
+		failure := exchangeFailure(m, err)
+		if failure != nil {
+			rtt = failureRTT(c)
+		}
+		nameserver.record(rtt, failure, maxFails, failTimeout)
 		if err != nil {
 			logger.Warn("%s socket error on %s", qname, nameserver)
 			logger.Warn("error:%s", err.Error())
@@ -153,13 +98,21 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error
 		// However, other Error code like NXDOMAIN is an clear response stating
 		// that it has been verified no such domain existas and ask other resolvers
 		// would make no sense. See more about #20
-		if r != nil && r.Rcode != dns.RcodeSuccess {
+		if m != nil && m.Rcode != dns.RcodeSuccess {
 			logger.Warn("%s failed to get an valid answer on %s", qname, nameserver)
-			if r.Rcode == dns.RcodeServerFailure {
+			if m.Rcode == dns.RcodeServerFailure {
 				return
 			}
 		}
-		re := &RResp{r, nameserver, rtt}
+		// Answers with a bogus-nxdomain address stand for NXDOMAIN.
+		if m != nil && r.isBogus(m) {
+			logger.Debug("%s bogus answer on %s", qname, nameserver)
+			nx := new(dns.Msg)
+			nx.SetRcode(req, dns.RcodeNameError)
+			nx.RecursionAvailable = m.RecursionAvailable
+			m = nx
+		}
+		re := &RResp{m, nameserver, rtt}
 		select {
 		case res <- re:
 		default:
@@ -168,11 +121,16 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error
 
 	ticker := time.NewTicker(time.Duration(conf.ResolvConfig.Interval) * time.Millisecond)
 	defer ticker.Stop()
-	// Start lookup on each nameserver top-down, in every second
+	// Start lookup on each nameserver in the order of the strategy, every
+	// interval, or on all of them at once for race.
+	strategy := r.strategyFor(qname)
 	nameservers := r.Nameservers(qname)
 	for _, nameserver := range nameservers {
 		wg.Add(1)
 		go L(nameserver)
+		if strategy == strategyRace {
+			continue
+		}
 		// but exit early, if we have an answer
 		select {
 		case re := <-res:
@@ -182,38 +140,52 @@ func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error
 			continue
 		}
 	}
-	// wait for all the namservers to finish
-	wg.Wait()
+	// wait for the first answer, or for all the namservers to finish
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case re := <-res:
+		logger.Debug("%s resolv on %s rtt: %v", UnFqdn(qname), re.nameserver, re.rtt)
+		return re.msg, nil
+	case <-done:
+	}
 	select {
 	case re := <-res:
 		logger.Debug("%s resolv on %s rtt: %v", UnFqdn(qname), re.nameserver, re.rtt)
 		return re.msg, nil
 	default:
-		return nil, ResolvError{qname, net, nameservers}
+		var names []string
+		for _, nameserver := range nameservers {
+			names = append(names, nameserver.String())
+		}
+		return nil, ResolvError{qname, net, names}
 	}
 }
 
-// Namservers return the array of nameservers, with port number appended.
-// '#' in the name is treated as port separator, as with dnsmasq.
-
-func (r *Resolver) Nameservers(qname string) []string {
-	queryKeys := strings.Split(qname, ".")
-	queryKeys = queryKeys[:len(queryKeys)-1] // ignore last '.'
-
-	var ns []string
-	if v, found := r.domainServer.search(queryKeys); found {
-		logger.Debug("%s be found in domain server list, upstream: %v", qname, v)
-		server := v
-		nameserver := net.JoinHostPort(server, "53")
-		ns = append(ns, nameserver)
-		// Ensure query the specific upstream nameserver in async Lookup() function.
-		return ns
+// Namservers return the upstreams for qname: the domain specific ones if
+// any, the default ones otherwise, in the order of the strategy for qname.
+// Upstreams which are down are left out.
+func (r *Resolver) Nameservers(qname string) []*Upstream {
+	rt := r.routes.Load()
+	strategy := r.strategyFor(qname)
+	if specs, found := rt.domainServer.search(domainKeys(qname)); found && !containsString(specs, serverDefault) {
+		logger.Debug("%s be found in domain server list, upstreams: %v", qname, specs)
+		// Ensure query the specific upstream nameservers in async Lookup() function.
+		var us []*Upstream
+		for _, spec := range specs {
+			if u, err := r.upstreams.get(spec); err == nil {
+				us = append(us, u)
+			}
+		}
+		if len(us) > 0 {
+			return r.order(strategy, strings.Join(specs, " "), r.healthy(us))
+		}
 	}
 
-	for _, nameserver := range r.servers {
-		ns = append(ns, nameserver)
-	}
-	return ns
+	return r.order(strategy, ".", r.healthy(rt.servers))
 }
 
 func (r *Resolver) Timeout() time.Duration {
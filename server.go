@@ -1,34 +1,300 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Server answers on the listeners of conf.Server with one GODNSHandler.
 type Server struct {
-	listen   string
-	rTimeout time.Duration
-	wTimeout time.Duration
+	handler *GODNSHandler
+
+	listeners []listener
+	errs      chan error
+}
+
+// listener is a bound endpoint of the server.
+type listener interface {
+	// Serve answers until Shutdown is called.
+	Serve() error
+	// Shutdown stops accepting queries and waits for those in flight
+	// until ctx is done.
+	Shutdown(ctx context.Context) error
+	// Close releases the socket of a listener which never served.
+	Close() error
+	String() string
 }
 
-func (s *Server) Run() {
+// Start binds every configured listener and serves them in the background.
+// If any of them fails to bind, the others are closed and the error is
+// returned. Errors of listeners which fail later on are sent to Errors.
+func (s *Server) Start() error {
 	h := NewHandler()
+	s.handler = h
+
+	if err := s.bind(h); err != nil {
+		s.close()
+		return err
+	}
+
+	s.errs = make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		l := l
+		logger.Info("Start %s", l)
+		go func() {
+			if err := l.Serve(); err != nil {
+				s.errs <- fmt.Errorf("%s failed: %w", l, err)
+			}
+		}()
+	}
+
+	// dns.Server can only be shut down once it has started serving.
+	for _, l := range s.listeners {
+		if dl, ok := l.(*dnsListener); ok {
+			select {
+			case <-dl.started:
+			case <-dl.done:
+			}
+		}
+	}
+	return nil
+}
+
+// close releases the listeners which are bound but not served yet.
+func (s *Server) close() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+// Errors reports the listeners which stopped serving on their own.
+func (s *Server) Errors() <-chan error {
+	return s.errs
+}
+
+// Reload swaps in the upstreams of the server-list and resolv files as they
+// are now; the listeners keep serving meanwhile.
+func (s *Server) Reload() error {
+	return s.handler.resolver.Reload()
+}
+
+// Shutdown stops every listener, waits for the queries in flight until ctx
+// is done, and saves the cache snapshot.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.listeners))
+	for i, l := range s.listeners {
+		wg.Add(1)
+		go func(i int, l listener) {
+			defer wg.Done()
+			if err := l.Shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("shutdown %s: %w", l, err)
+			}
+		}(i, l)
+	}
+	wg.Wait()
+	s.listeners = nil
+
+	if s.handler != nil {
+		s.handler.SaveSnapshot()
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) bind(h *GODNSHandler) error {
+	var certs *certReloader
+	if conf.Server.TLSCert != "" {
+		var err error
+		if certs, err = newCertReloader(conf.Server.TLSCert, conf.Server.TLSKey); err != nil {
+			return fmt.Errorf("load certificate %s: %w", conf.Server.TLSCert, err)
+		}
+	}
+
+	for _, lc := range conf.Server.listeners() {
+		if err := s.bindListener(h, lc, certs); err != nil {
+			return err
+		}
+	}
+
+	if conf.Admin.Listen != "" {
+		admin := &AdminServer{listen: conf.Admin.Listen, handler: h}
+		if err := s.bindHTTP("admin", admin.httpServer()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindListener binds every protocol of lc. The encrypted ones need certs.
+func (s *Server) bindListener(h *GODNSHandler, lc ListenerConf, certs *certReloader) error {
+	acl, err := NewACL(lc.Allow, lc.Deny)
+	if err != nil {
+		return fmt.Errorf("access list of %s: %w", lc.Listen, err)
+	}
+	rTimeout, wTimeout := lc.timeouts()
 
-	th := dns.NewServeMux()
-	th.HandleFunc(".", h.DoTCP)
-	ts := &dns.Server{Addr: s.listen, Net: "tcp", Handler: th, ReadTimeout: s.rTimeout, WriteTimeout: s.wTimeout}
-	go s.start(ts)
+	for _, proto := range lc.protocols() {
+		if certs == nil && (proto == protoDoT || proto == protoDoQ) {
+			return fmt.Errorf("%s listener on %s needs tls-cert", proto, lc.Listen)
+		}
 
-	uh := dns.NewServeMux()
-	uh.HandleFunc(".", h.DoUDP)
-	us := &dns.Server{Addr: s.listen, Net: "udp", Handler: uh, UDPSize: 65535, ReadTimeout: s.rTimeout, WriteTimeout: s.wTimeout}
-	go s.start(us)
+		switch proto {
+		case protoUDP:
+			err = s.bindDNS(&dns.Server{Addr: lc.Listen, Net: "udp", Handler: acl.Handler(h.DoUDP), UDPSize: 65535, ReadTimeout: rTimeout, WriteTimeout: wTimeout})
+		case protoTCP:
+			err = s.bindDNS(&dns.Server{Addr: lc.Listen, Net: "tcp", Handler: acl.Handler(h.DoTCP), ReadTimeout: rTimeout, WriteTimeout: wTimeout})
+		case protoDoT:
+			err = s.bindDNS(&dns.Server{Addr: lc.Listen, Net: "tcp-tls", TLSConfig: certs.TLSConfig(), Handler: acl.Handler(h.DoTLS), ReadTimeout: rTimeout, WriteTimeout: wTimeout})
+		case protoDoH:
+			path := conf.Server.DoHPath
+			if path == "" {
+				path = "/dns-query"
+			}
+			doh := &DoHServer{listen: lc.Listen, path: path, handler: acl.Handler(h.DoHTTPS), certs: certs}
+			srv := doh.httpServer()
+			srv.ReadTimeout, srv.WriteTimeout = rTimeout, wTimeout
+			err = s.bindHTTP("doh", srv)
+		case protoDoQ:
+			idle := conf.Server.QUICIdleTimeout
+			if idle <= 0 {
+				idle = 30
+			}
+			doq := &DoQServer{
+				listen:      lc.Listen,
+				handler:     acl.Handler(h.DoQUIC),
+				certs:       certs,
+				idleTimeout: time.Duration(idle) * time.Second,
+				rTimeout:    rTimeout,
+				wTimeout:    wTimeout,
+			}
+			if err = doq.Listen(); err != nil {
+				err = fmt.Errorf("listen quic on %s: %w", lc.Listen, err)
+			} else {
+				s.listeners = append(s.listeners, doq)
+			}
+		default:
+			err = fmt.Errorf("unknown protocol %s of listener %s", proto, lc.Listen)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindDNS binds the socket of ds, so that a bind failure is reported
+// before anything is served.
+func (s *Server) bindDNS(ds *dns.Server) error {
+	var err error
+	switch ds.Net {
+	case "udp":
+		ds.PacketConn, err = net.ListenPacket("udp", ds.Addr)
+	case "tcp-tls":
+		var l net.Listener
+		if l, err = net.Listen("tcp", ds.Addr); err == nil {
+			ds.Listener = tls.NewListener(l, ds.TLSConfig)
+		}
+	default:
+		ds.Listener, err = net.Listen("tcp", ds.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("listen %s on %s: %w", ds.Net, ds.Addr, err)
+	}
+	// Report the port the system picked for port 0.
+	if ds.PacketConn != nil {
+		ds.Addr = ds.PacketConn.LocalAddr().String()
+	} else {
+		ds.Addr = ds.Listener.Addr().String()
+	}
+
+	dl := &dnsListener{Server: ds, started: make(chan struct{}), done: make(chan struct{})}
+	ds.NotifyStartedFunc = func() { close(dl.started) }
+	s.listeners = append(s.listeners, dl)
+	return nil
+}
+
+func (s *Server) bindHTTP(name string, srv *http.Server) error {
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return fmt.Errorf("listen %s on %s: %w", name, srv.Addr, err)
+	}
+	srv.Addr = l.Addr().String()
+	s.listeners = append(s.listeners, &httpListener{Server: srv, l: l, name: name})
+	return nil
+}
+
+// dnsListener serves a dns.Server on its bound socket.
+type dnsListener struct {
+	*dns.Server
+	started chan struct{}
+	done    chan struct{}
 }
 
-func (s *Server) start(ds *dns.Server) {
-	logger.Info("Start %s listener on %s", ds.Net, s.listen)
-	if err := ds.ListenAndServe(); err != nil {
-		logger.Error("Start %s listener on %s failed:%s", ds.Net, s.listen, err.Error())
+func (l *dnsListener) Serve() error {
+	defer close(l.done)
+	return l.ActivateAndServe()
+}
+
+func (l *dnsListener) Shutdown(ctx context.Context) error {
+	select {
+	case <-l.done:
+		return nil
+	default:
+		return l.ShutdownContext(ctx)
 	}
 }
+
+func (l *dnsListener) Close() error {
+	if l.PacketConn != nil {
+		return l.PacketConn.Close()
+	}
+	return l.Listener.Close()
+}
+
+func (l *dnsListener) String() string {
+	return l.Net + " listener on " + l.Addr
+}
+
+// httpListener serves an http.Server on its bound socket, over TLS if the
+// server has a TLS configuration.
+type httpListener struct {
+	*http.Server
+	l    net.Listener
+	name string
+}
+
+func (l *httpListener) Serve() error {
+	var err error
+	if l.TLSConfig != nil {
+		err = l.ServeTLS(l.l, "", "")
+	} else {
+		err = l.Server.Serve(l.l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (l *httpListener) Shutdown(ctx context.Context) error {
+	err := l.Server.Shutdown(ctx)
+	l.l.Close()
+	return err
+}
+
+func (l *httpListener) Close() error {
+	return l.l.Close()
+}
+
+func (l *httpListener) String() string {
+	return l.name + " listener on " + l.Addr
+}
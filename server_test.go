@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// listenAddr returns the address the i-th listener of s is bound to.
+func listenAddr(s *Server, i int) string {
+	return s.listeners[i].(*dnsListener).Addr
+}
+
+// newTestServer configures a server forwarding to upstream, with a cache
+// snapshot in a temporary directory.
+func newTestServer(t *testing.T, upstream *upstreamStandin) *Server {
+	dir := t.TempDir()
+	host, port, _ := net.SplitHostPort(upstream.addr)
+	servers := filepath.Join(dir, "servers.conf")
+	if err := os.WriteFile(servers, []byte("server="+host+"#"+port+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := conf
+	t.Cleanup(func() { conf = saved })
+	conf = Conf{
+		Server:       DNSServerConf{Listen: "127.0.0.1:0"},
+		ResolvConfig: ResolvConf{Timeout: 2, Interval: 200, ServerListFile: servers},
+		Cache:        CacheConf{Expire: 600, SnapshotFile: filepath.Join(dir, "cache")},
+	}
+	return &Server{}
+}
+
+func TestListenerConf(t *testing.T) {
+	Convey("Plain DNS is served on :53 unless listen or listeners are set", t, func() {
+		So(DNSServerConf{}.listeners(), ShouldResemble, []ListenerConf{{Listen: ":53"}})
+		So(DNSServerConf{TLSListen: ":853"}.listeners(), ShouldResemble, []ListenerConf{
+			{Listen: ":53"}, {Listen: ":853", Protocols: []string{protoDoT}}})
+		So(DNSServerConf{Listen: ":5301"}.listeners(), ShouldResemble, []ListenerConf{{Listen: ":5301"}})
+
+		lan := ListenerConf{Listen: "192.168.1.1:53"}
+		So(DNSServerConf{Listeners: []ListenerConf{lan}}.listeners(), ShouldResemble, []ListenerConf{lan})
+	})
+}
+
+func TestServerLifecycle(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	Convey("A server drains the queries in flight on shutdown", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 60)
+		upstream.delay.Store(int64(300 * time.Millisecond))
+		s := newTestServer(t, upstream)
+		So(s.Start(), ShouldBeNil)
+		udpAddr, tcpAddr := listenAddr(s, 0), listenAddr(s, 1)
+
+		answered := make(chan *dns.Msg, 1)
+		go func() {
+			m, _, _ := new(dns.Client).Exchange(req, udpAddr)
+			answered <- m
+		}()
+		for upstream.queries.Load() == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		So(s.Shutdown(ctx), ShouldBeNil)
+
+		m := <-answered
+		So(m, ShouldNotBeNil)
+		So(m.Answer, ShouldHaveLength, 1)
+
+		_, err := os.Stat(conf.Cache.SnapshotFile)
+		So(err, ShouldBeNil)
+
+		c := &dns.Client{Net: "tcp", Timeout: 200 * time.Millisecond}
+		_, _, err = c.Exchange(req, tcpAddr)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("A server which can't bind every listener fails to start", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 60)
+		s := newTestServer(t, upstream)
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer busy.Close()
+		conf.Admin.Listen = busy.Addr().String()
+
+		So(s.Start(), ShouldNotBeNil)
+		So(s.listeners, ShouldBeEmpty)
+
+		// The listeners bound before the failure are released.
+		So(s.bind(NewHandler()), ShouldNotBeNil)
+		bound := s.listeners
+		So(bound, ShouldHaveLength, 2)
+		s.close()
+		So(bound[0].(*dnsListener).PacketConn.SetDeadline(time.Now()), ShouldNotBeNil)
+		_, err = bound[1].(*dnsListener).Listener.Accept()
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Every listener answers with its own protocols and access list", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 60)
+		s := newTestServer(t, upstream)
+		conf.Server.Listeners = []ListenerConf{
+			{Listen: "127.0.0.1:0", Protocols: []string{"tcp"}, ReadTimeout: 1, Allow: []string{"127.0.0.0/8"}},
+			{Listen: "127.0.0.1:0", Protocols: []string{"udp"}, Deny: []string{"127.0.0.1"}},
+		}
+		So(s.Start(), ShouldBeNil)
+		defer s.Shutdown(context.Background())
+		tcpOnly, refused := listenAddr(s, 2), listenAddr(s, 3)
+
+		tcp := &dns.Client{Net: "tcp", Timeout: time.Second}
+		m, _, err := tcp.Exchange(req, tcpOnly)
+		So(err, ShouldBeNil)
+		So(m.Rcode, ShouldEqual, dns.RcodeSuccess)
+
+		udp := &dns.Client{Timeout: 200 * time.Millisecond}
+		_, _, err = udp.Exchange(req, tcpOnly)
+		So(err, ShouldNotBeNil)
+
+		m, _, err = udp.Exchange(req, refused)
+		So(err, ShouldBeNil)
+		So(m.Rcode, ShouldEqual, dns.RcodeRefused)
+	})
+
+	Convey("Listeners with an unknown protocol fail to start", t, func() {
+		s := newTestServer(t, newUpstreamStandin(t, "192.0.2.1", 60))
+		conf.Server.Listeners = []ListenerConf{{Listen: "127.0.0.1:0", Protocols: []string{"smoke-signals"}}}
+		So(s.Start(), ShouldNotBeNil)
+	})
+}
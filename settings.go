@@ -2,6 +2,7 @@ package main
 
 import (
 	"strconv"
+	"time"
 )
 
 var conf Conf
@@ -23,6 +24,7 @@ type Conf struct {
 	Log          LogConf       `toml:"log"`
 	Cache        CacheConf     `toml:"cache"`
 	Hosts        HostsConf     `toml:"hosts"`
+	Admin        AdminConf     `toml:"admin"`
 }
 
 type ResolvConf struct {
@@ -31,10 +33,105 @@ type ResolvConf struct {
 	SetEDNS0       bool
 	ServerListFile string `toml:"server-list-file"`
 	ResolvFile     string `toml:"resolv-file"`
+	// An upstream is skipped after MaxFails consecutive failures, until a
+	// probe query succeeds; probes are sent every FailTimeout seconds.
+	// A negative MaxFails disables the health checks.
+	MaxFails    int `toml:"max-fails"`
+	FailTimeout int `toml:"fail-timeout"`
+	// Strategy picks the order upstreams are asked in: ordered,
+	// round-robin, random, fastest or race. Strategies overrides it for
+	// the names under a domain.
+	Strategy   string            `toml:"strategy"`
+	Strategies map[string]string `toml:"strategies"`
+	// ReloadInterval is how often, in seconds, the server-list and resolv
+	// files are checked for changes. Negative disables the checks.
+	ReloadInterval int `toml:"reload-interval"`
 }
 
 type DNSServerConf struct {
 	Listen string `toml:"listen"`
+	// TLSListen enables DNS-over-TLS on this address, usually port 853,
+	// with the certificate and key in TLSCert and TLSKey.
+	TLSListen string `toml:"tls-listen"`
+	TLSCert   string `toml:"tls-cert"`
+	TLSKey    string `toml:"tls-key"`
+	// DoHListen enables DNS-over-HTTPS on this address and DoHPath, over
+	// TLS with the certificate above if set, plain HTTP otherwise.
+	DoHListen string `toml:"doh-listen"`
+	DoHPath   string `toml:"doh-path"`
+	// QUICListen enables DNS-over-QUIC on this udp address with the
+	// certificate above. Idle connections are closed after
+	// QUICIdleTimeout seconds.
+	QUICListen      string `toml:"quic-listen"`
+	QUICIdleTimeout int    `toml:"quic-idle-timeout"`
+	// Listeners are served besides the addresses above, each with its
+	// own protocols, timeouts and access list.
+	Listeners []ListenerConf `toml:"listeners"`
+}
+
+// Listener protocols.
+const (
+	protoUDP = "udp"
+	protoTCP = "tcp"
+	protoDoT = "dot"
+	protoDoH = "doh"
+	protoDoQ = "doq"
+)
+
+// ListenerConf is an address godns answers on. Protocols default to udp
+// and tcp, timeouts to 5 seconds. Clients matching Deny, or not matching
+// Allow if set, are refused.
+type ListenerConf struct {
+	Listen       string   `toml:"listen"`
+	Protocols    []string `toml:"protocols"`
+	ReadTimeout  int      `toml:"read-timeout"`
+	WriteTimeout int      `toml:"write-timeout"`
+	Allow        []string `toml:"allow"`
+	Deny         []string `toml:"deny"`
+}
+
+// defaultListen is the address of plain DNS if neither listen nor
+// listeners are set, as it was before listeners existed.
+const defaultListen = ":53"
+
+// listeners returns the configured listeners, those of the single address
+// settings first.
+func (c DNSServerConf) listeners() []ListenerConf {
+	var ls []ListenerConf
+	switch {
+	case c.Listen != "":
+		ls = append(ls, ListenerConf{Listen: c.Listen})
+	case len(c.Listeners) == 0:
+		ls = append(ls, ListenerConf{Listen: defaultListen})
+	}
+	if c.TLSListen != "" {
+		ls = append(ls, ListenerConf{Listen: c.TLSListen, Protocols: []string{protoDoT}})
+	}
+	if c.DoHListen != "" {
+		ls = append(ls, ListenerConf{Listen: c.DoHListen, Protocols: []string{protoDoH}})
+	}
+	if c.QUICListen != "" {
+		ls = append(ls, ListenerConf{Listen: c.QUICListen, Protocols: []string{protoDoQ}})
+	}
+	return append(ls, c.Listeners...)
+}
+
+func (c ListenerConf) protocols() []string {
+	if len(c.Protocols) == 0 {
+		return []string{protoUDP, protoTCP}
+	}
+	return c.Protocols
+}
+
+func (c ListenerConf) timeouts() (read, write time.Duration) {
+	read, write = 5*time.Second, 5*time.Second
+	if c.ReadTimeout > 0 {
+		read = time.Duration(c.ReadTimeout) * time.Second
+	}
+	if c.WriteTimeout > 0 {
+		write = time.Duration(c.WriteTimeout) * time.Second
+	}
+	return read, write
 }
 
 type RedisConf struct {
@@ -67,9 +164,42 @@ func (ls LogConf) LogLevel() int {
 }
 
 type CacheConf struct {
-	Backend  string
-	Expire   int
-	MaxCount int `toml:"max-count"`
+	Backend   string
+	Expire    int
+	MinTTL    int `toml:"min-ttl"`
+	MaxTTL    int `toml:"max-ttl"`
+	NegMaxTTL int `toml:"neg-max-ttl"`
+	MaxCount  int `toml:"max-count"`
+	Eviction  string
+	Sweep     int `toml:"sweep-interval"`
+	Shards    int
+
+	StaleTTL       int  `toml:"stale-ttl"`
+	StaleAnswerTTL int  `toml:"stale-answer-ttl"`
+	StaleEDE       bool `toml:"stale-ede"`
+
+	Prefetch     int
+	PrefetchHits int `toml:"prefetch-hits"`
+
+	SnapshotFile     string `toml:"snapshot-file"`
+	SnapshotInterval int    `toml:"snapshot-interval"`
+
+	L1MaxCount int `toml:"l1-max-count"`
+	L1MaxTTL   int `toml:"l1-max-ttl"`
+
+	InvalidationChannel string `toml:"invalidation-channel"`
+}
+
+// l1 returns the settings of the in-process cache in front of a remote backend.
+func (c CacheConf) l1() CacheConf {
+	l1 := c
+	l1.MaxCount = c.L1MaxCount
+	l1.MaxTTL = minPositive(c.MaxTTL, c.L1MaxTTL)
+	return l1
+}
+
+type AdminConf struct {
+	Listen string
 }
 
 type HostsConf struct {
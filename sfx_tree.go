@@ -1,8 +1,10 @@
 package main
 
+// suffixTreeNode maps domains, stored label by label from the top level
+// domain down, to the ordered list of their values.
 type suffixTreeNode struct {
 	key      string
-	value    string
+	values   []string
 	children map[string]*suffixTreeNode
 }
 
@@ -13,12 +15,25 @@ func newSuffixTreeRoot() *suffixTreeNode {
 func newSuffixTree(key string, value string) *suffixTreeNode {
 	root := &suffixTreeNode{
 		key:      key,
-		value:    value,
 		children: map[string]*suffixTreeNode{},
 	}
+	root.add(value)
 	return root
 }
 
+// add appends value to the values of node, once. Empty values are ignored.
+func (node *suffixTreeNode) add(value string) {
+	if value == "" {
+		return
+	}
+	for _, v := range node.values {
+		if v == value {
+			return
+		}
+	}
+	node.values = append(node.values, value)
+}
+
 func (node *suffixTreeNode) ensureSubTree(key string) {
 	if _, ok := node.children[key]; !ok {
 		node.children[key] = newSuffixTree(key, "")
@@ -27,7 +42,7 @@ func (node *suffixTreeNode) ensureSubTree(key string) {
 
 func (node *suffixTreeNode) insert(key string, value string) {
 	if c, ok := node.children[key]; ok {
-		c.value = value
+		c.add(value)
 	} else {
 		node.children[key] = newSuffixTree(key, value)
 	}
@@ -48,18 +63,28 @@ func (node *suffixTreeNode) sinsert(keys []string, value string) {
 	node.insert(key, value)
 }
 
-func (node *suffixTreeNode) search(keys []string) (string, bool) {
+// search returns the values of the longest suffix of keys which has some.
+func (node *suffixTreeNode) search(keys []string) ([]string, bool) {
+	values, n := node.longest(keys)
+	return values, n > 0
+}
+
+// longest returns the values of the longest suffix of keys which has some,
+// and the number of labels of that suffix, zero if there is none.
+func (node *suffixTreeNode) longest(keys []string) ([]string, int) {
 	if len(keys) == 0 {
-		return "", false
+		return nil, 0
 	}
 
 	key := keys[len(keys)-1]
 	if n, ok := node.children[key]; ok {
-		if nextValue, found := n.search(keys[:len(keys)-1]); found {
-			return nextValue, found
+		if nextValues, depth := n.longest(keys[:len(keys)-1]); depth > 0 {
+			return nextValues, depth + 1
+		}
+		if len(n.values) > 0 {
+			return n.values, 1
 		}
-		return n.value, (n.value != "")
 	}
 
-	return "", false
+	return nil, 0
 }
@@ -20,7 +20,7 @@ func Test_Suffix_Tree(t *testing.T) {
 
 		v, found = root.search(strings.Split("baidu.cn", "."))
 		So(found, ShouldEqual, true)
-		So(v, ShouldEqual, "166.111.8.28")
+		So(v, ShouldResemble, []string{"166.111.8.28"})
 	})
 
 	Convey("Google should be found", t, func() {
@@ -31,22 +31,33 @@ func Test_Suffix_Tree(t *testing.T) {
 
 		v, found := root.search(strings.Split("google.com", "."))
 		So(found, ShouldEqual, true)
-		So(v, ShouldEqual, "8.8.8.8")
+		So(v, ShouldResemble, []string{"8.8.8.8"})
 
 		v, found = root.search(strings.Split("www.google.com", "."))
 		So(found, ShouldEqual, true)
-		So(v, ShouldEqual, "8.8.8.8")
+		So(v, ShouldResemble, []string{"8.8.8.8"})
 
 		v, found = root.search(strings.Split("scholar.google.com", "."))
 		So(found, ShouldEqual, true)
-		So(v, ShouldEqual, "208.67.222.222")
+		So(v, ShouldResemble, []string{"208.67.222.222"})
 
 		v, found = root.search(strings.Split("twitter.com", "."))
 		So(found, ShouldEqual, true)
-		So(v, ShouldEqual, "8.8.8.8")
+		So(v, ShouldResemble, []string{"8.8.8.8"})
 
 		v, found = root.search(strings.Split("baidu.cn", "."))
 		So(found, ShouldEqual, true)
-		So(v, ShouldEqual, "166.111.8.28")
+		So(v, ShouldResemble, []string{"166.111.8.28"})
+	})
+
+	Convey("A domain keeps every value in order", t, func() {
+		root := newSuffixTreeRoot()
+		root.sinsert(strings.Split("corp.example", "."), "10.0.0.1#5353")
+		root.sinsert(strings.Split("corp.example", "."), "10.0.0.2")
+		root.sinsert(strings.Split("corp.example", "."), "10.0.0.1#5353")
+
+		v, found := root.search(strings.Split("git.corp.example", "."))
+		So(found, ShouldBeTrue)
+		So(v, ShouldResemble, []string{"10.0.0.1#5353", "10.0.0.2"})
 	})
 }
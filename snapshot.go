@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Snapshotter is implemented by caches which can be saved to a snapshot
+// file on shutdown and restored from it on startup.
+type Snapshotter interface {
+	Snapshot() []SnapshotEntry
+	Restore(entries []SnapshotEntry) int
+}
+
+// SnapshotEntry is a cache entry as stored in a snapshot file.
+// Msg is the packed message, empty for the nil messages of failures.
+type SnapshotEntry struct {
+	Key    CacheKey
+	Msg    []byte
+	Stored time.Time
+	Expire time.Time
+	Hits   uint64
+}
+
+func newSnapshotEntry(key CacheKey, m *Msg) (SnapshotEntry, error) {
+	e := SnapshotEntry{Key: key, Stored: m.Stored, Expire: m.Expire, Hits: m.Hits.Load()}
+	if m.Msg != nil {
+		b, err := m.Msg.Pack()
+		if err != nil {
+			return e, SerializerError{err}
+		}
+		e.Msg = b
+	}
+	return e, nil
+}
+
+func (e SnapshotEntry) msg() (*Msg, error) {
+	m := &Msg{Stored: e.Stored, Expire: e.Expire}
+	m.Hits.Store(e.Hits)
+	if len(e.Msg) > 0 {
+		m.Msg = new(dns.Msg)
+		if err := m.Msg.Unpack(e.Msg); err != nil {
+			return nil, SerializerError{err}
+		}
+	}
+	return m, nil
+}
+
+// SaveSnapshot writes the snapshots of the named caches to path. The file is
+// replaced atomically, so a crash never leaves a truncated snapshot behind.
+func SaveSnapshot(path string, caches map[string]Cache) error {
+	snapshot := make(map[string][]SnapshotEntry, len(caches))
+	for name, c := range caches {
+		if s, ok := c.(Snapshotter); ok {
+			snapshot[name] = s.Snapshot()
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = gob.NewEncoder(f).Encode(snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadSnapshot reads the cache snapshots saved by SaveSnapshot, by cache name.
+func ReadSnapshot(path string) (map[string][]SnapshotEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var snapshot map[string][]SnapshotEntry
+	if err = gob.NewDecoder(f).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// LoadSnapshot restores the named caches from the snapshot at path and
+// returns the number of restored entries.
+func LoadSnapshot(path string, caches map[string]Cache) (int, error) {
+	snapshot, err := ReadSnapshot(path)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for name, c := range caches {
+		if s, ok := c.(Snapshotter); ok {
+			n += s.Restore(snapshot[name])
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSnapshot(t *testing.T) {
+	Convey("Memory caches survive a snapshot round trip", t, func() {
+		path := filepath.Join(t.TempDir(), "godns.cache")
+
+		c := NewMemoryCache(CacheConf{Expire: 600})
+		neg := NewShardedMemoryCache(CacheConf{Expire: 600, Shards: 4})
+		So(c.Set(testKey("a"), newTestMsg("a.com", 60)), ShouldBeNil)
+		So(c.Set(testKey("fail"), nil), ShouldBeNil)
+		So(c.Set(testKey("old"), newTestMsg("old.com", 60)), ShouldBeNil)
+		c.Backend[testKey("old")].Expire = time.Now().Add(-time.Second)
+		So(neg.Set(testKey("nx"), newTestNegativeMsg("nx.com", 3, 900, 60)), ShouldBeNil)
+		c.Get(testKey("a"))
+
+		So(SaveSnapshot(path, map[string]Cache{"cache": c, "negative": neg}), ShouldBeNil)
+
+		c2 := NewMemoryCache(CacheConf{Expire: 600})
+		neg2 := NewShardedMemoryCache(CacheConf{Expire: 600, Shards: 2})
+		n, err := LoadSnapshot(path, map[string]Cache{"cache": c2, "negative": neg2})
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 3)
+
+		m, err := c2.Get(testKey("a"))
+		So(err, ShouldBeNil)
+		So(m.Answer, ShouldHaveLength, 1)
+		So(c2.Backend[testKey("a")].Expire.Equal(c.Backend[testKey("a")].Expire), ShouldBeTrue)
+		So(c2.Backend[testKey("a")].Hits.Load(), ShouldEqual, 2)
+
+		m, err = c2.Get(testKey("fail"))
+		So(err, ShouldBeNil)
+		So(m, ShouldBeNil)
+
+		So(c2.Exists(testKey("old")), ShouldBeFalse)
+
+		m, err = neg2.Get(testKey("nx"))
+		So(err, ShouldBeNil)
+		So(m.Rcode, ShouldEqual, 3)
+	})
+}
+
+func TestDump(t *testing.T) {
+	Convey("Snapshots dump as readable entries", t, func() {
+		path := filepath.Join(t.TempDir(), "godns.cache")
+
+		c := NewMemoryCache(CacheConf{Expire: 600})
+		So(c.Set(testKey("www.example.com"), newTestMsg("www.example.com", 60)), ShouldBeNil)
+		So(c.Set(testKey("fail.com"), nil), ShouldBeNil)
+		neg := NewMemoryCache(CacheConf{Expire: 600})
+		So(neg.Set(testKey("nx.example.com"), newTestNegativeMsg("nx.example.com", 3, 900, 60)), ShouldBeNil)
+		So(SaveSnapshot(path, map[string]Cache{"cache": c, "negative": neg}), ShouldBeNil)
+
+		snapshot, err := ReadSnapshot(path)
+		So(err, ShouldBeNil)
+		entries := Dump(snapshot, Purge{}, time.Now())
+		So(entries, ShouldHaveLength, 3)
+
+		So(entries[0].Cache, ShouldEqual, "cache")
+		So(entries[0].Key, ShouldEqual, "fail.com.:IN:A")
+		So(entries[0].Rcode, ShouldEqual, "FAILURE")
+
+		So(entries[1].Key, ShouldEqual, "www.example.com.:IN:A")
+		So(entries[1].Rcode, ShouldEqual, "NOERROR")
+		So(entries[1].Answer, ShouldHaveLength, 1)
+		So(entries[1].TTL, ShouldBeBetweenOrEqual, 58, 60)
+
+		So(entries[2].Cache, ShouldEqual, "negative")
+		So(entries[2].Rcode, ShouldEqual, "NXDOMAIN")
+		So(entries[2].Authority, ShouldHaveLength, 1)
+
+		entries = Dump(snapshot, Purge{Name: "example.com.", Suffix: true}, time.Now())
+		So(entries, ShouldHaveLength, 2)
+
+		var buf bytes.Buffer
+		So(WriteDump(&buf, entries, "text"), ShouldBeNil)
+		So(buf.String(), ShouldContainSubstring, "www.example.com.:IN:A NOERROR ttl=")
+
+		buf.Reset()
+		So(DumpSnapshot(&buf, path, "json"), ShouldBeNil)
+		var decoded []DumpEntry
+		So(json.Unmarshal(buf.Bytes(), &decoded), ShouldBeNil)
+		So(decoded, ShouldHaveLength, 3)
+	})
+}
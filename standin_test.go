@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type standinValue struct {
+	val    []byte
+	expire time.Time
+}
+
+// standinStore is the key value store behind the protocol stand-ins.
+type standinStore struct {
+	mu   sync.Mutex
+	data map[string]standinValue
+}
+
+func (s *standinStore) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	if !ok || (!v.expire.IsZero() && v.expire.Before(time.Now())) {
+		delete(s.data, key)
+		return nil, false
+	}
+	return v.val, true
+}
+
+func (s *standinStore) set(key string, val []byte, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := standinValue{val: val}
+	if ttl > 0 {
+		v.expire = time.Now().Add(ttl)
+	}
+	s.data[key] = v
+}
+
+func (s *standinStore) del(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.data[key]
+	delete(s.data, key)
+	return ok
+}
+
+func (s *standinStore) keys(pattern string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.data {
+		if ok, _ := path.Match(pattern, k); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (s *standinStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = make(map[string]standinValue)
+}
+
+// serveStandin accepts connections on a local port until the test ends.
+func serveStandin(t *testing.T, serve func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// redisStandin speaks enough of the redis protocol for the cache tests.
+type redisStandin struct {
+	standinStore
+	addr        string
+	subscribers map[string][]*redisStandinConn
+}
+
+// redisStandinConn serializes the replies and the published messages
+// written to a connection.
+type redisStandinConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *redisStandinConn) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	io.WriteString(c.Conn, s)
+}
+
+func newRedisStandin(t *testing.T) *redisStandin {
+	s := &redisStandin{
+		standinStore: standinStore{data: make(map[string]standinValue)},
+		subscribers:  make(map[string][]*redisStandinConn),
+	}
+	s.addr = serveStandin(t, s.serve)
+	return s
+}
+
+// subscriberCount returns how many connections listen on channel.
+func (s *redisStandin) subscriberCount(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers[channel])
+}
+
+func (s *redisStandin) conf() RedisConf {
+	host, port, _ := net.SplitHostPort(s.addr)
+	p, _ := strconv.Atoi(port)
+	return RedisConf{Host: host, Port: p}
+}
+
+func (s *redisStandin) serve(conn net.Conn) {
+	c := &redisStandinConn{Conn: conn}
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+		c.write(s.exec(c, args))
+	}
+}
+
+func (s *redisStandin) exec(c *redisStandinConn, args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "SUBSCRIBE":
+		s.mu.Lock()
+		s.subscribers[args[1]] = append(s.subscribers[args[1]], c)
+		s.mu.Unlock()
+		return "*3\r\n" + redisBulk("subscribe") + redisBulk(args[1]) + ":1\r\n"
+	case "PUBLISH":
+		s.mu.Lock()
+		subscribers := s.subscribers[args[1]]
+		s.mu.Unlock()
+		for _, sub := range subscribers {
+			sub.write("*3\r\n" + redisBulk("message") + redisBulk(args[1]) + redisBulk(args[2]))
+		}
+		return ":" + strconv.Itoa(len(subscribers)) + "\r\n"
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		if v, ok := s.get(args[1]); ok {
+			return redisBulk(string(v))
+		}
+		return "$-1\r\n"
+	case "SET":
+		s.set(args[1], []byte(args[2]), 0)
+		return "+OK\r\n"
+	case "SETEX":
+		sec, err := strconv.Atoi(args[2])
+		if err != nil || sec <= 0 {
+			return "-ERR invalid expire time\r\n"
+		}
+		s.set(args[1], []byte(args[3]), time.Duration(sec)*time.Second)
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if s.del(k) {
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "EXISTS":
+		if _, ok := s.get(args[1]); ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "KEYS":
+		keys := s.keys(args[1])
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(keys))
+		for _, k := range keys {
+			b.WriteString(redisBulk(k))
+		}
+		return b.String()
+	case "FLUSHDB", "FLUSHALL":
+		s.flush()
+		return "+OK\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func redisBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// readRedisCommand reads a multi bulk or an inline command.
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(line[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// memcacheStandin speaks enough of the memcache text protocol for the cache tests.
+type memcacheStandin struct {
+	standinStore
+	addr string
+}
+
+func newMemcacheStandin(t *testing.T) *memcacheStandin {
+	s := &memcacheStandin{standinStore: standinStore{data: make(map[string]standinValue)}}
+	s.addr = serveStandin(t, s.serve)
+	return s
+}
+
+func (s *memcacheStandin) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "get", "gets":
+			for _, k := range args[1:] {
+				if v, ok := s.get(k); ok {
+					fmt.Fprintf(conn, "VALUE %s 0 %d 0\r\n%s\r\n", k, len(v), v)
+				}
+			}
+			io.WriteString(conn, "END\r\n")
+		case "set":
+			exptime, _ := strconv.Atoi(args[3])
+			size, _ := strconv.Atoi(args[4])
+			buf := make([]byte, size+2)
+			if _, err = io.ReadFull(r, buf); err != nil {
+				return
+			}
+			s.set(args[1], buf[:size], time.Duration(exptime)*time.Second)
+			io.WriteString(conn, "STORED\r\n")
+		case "delete":
+			if s.del(args[1]) {
+				io.WriteString(conn, "DELETED\r\n")
+			} else {
+				io.WriteString(conn, "NOT_FOUND\r\n")
+			}
+		case "flush_all":
+			s.flush()
+			io.WriteString(conn, "OK\r\n")
+		default:
+			io.WriteString(conn, "ERROR\r\n")
+		}
+	}
+}
+
+// upstreamStandin is a nameserver on udp and tcp which answers every A
+// query with A after its delay and counts the queries it gets. With rcode
+// set it answers every query with that rcode instead. Answers without
+// records carry the SOA of example., with TTL as its minimum.
+type upstreamStandin struct {
+	addr    string
+	A       net.IP
+	TTL     uint32
+	delay   atomic.Int64
+	rcode   atomic.Int32
+	queries atomic.Int64
+}
+
+func newUpstreamStandin(t *testing.T, a string, ttl uint32) *upstreamStandin {
+	s := &upstreamStandin{A: net.ParseIP(a), TTL: ttl}
+
+	pc, ln := listenUDPAndTCP(t)
+	s.addr = pc.LocalAddr().String()
+
+	for _, ds := range []*dns.Server{{PacketConn: pc, Handler: s}, {Listener: ln, Handler: s}} {
+		ds := ds
+		go ds.ActivateAndServe()
+		t.Cleanup(func() { ds.Shutdown() })
+	}
+	return s
+}
+
+// listenUDPAndTCP binds udp and tcp sockets on the same local port. The
+// tcp port is picked first and, if it is taken on udp, another one is.
+func listenUDPAndTCP(t *testing.T) (net.PacketConn, net.Listener) {
+	for i := 0; i < 20; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := net.ListenPacket("udp", ln.Addr().String())
+		if err == nil {
+			return pc, ln
+		}
+		ln.Close()
+	}
+	t.Fatal("no local port free on both udp and tcp")
+	return nil, nil
+}
+
+func (s *upstreamStandin) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.queries.Add(1)
+	time.Sleep(time.Duration(s.delay.Load()))
+	m := new(dns.Msg)
+	m.SetRcode(req, int(s.rcode.Load()))
+	m.RecursionAvailable = true
+	if q := req.Question[0]; q.Qtype == dns.TypeA && m.Rcode == dns.RcodeSuccess {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: s.TTL},
+			A:   s.A,
+		})
+	}
+	if len(m.Answer) == 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:     dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      "ns.example.",
+			Mbox:    "hostmaster.example.",
+			Refresh: 3600, Retry: 600, Expire: 86400, Minttl: s.TTL,
+		})
+	}
+	w.WriteMsg(m)
+}
+
+// recorder is a dns.ResponseWriter which keeps the messages written to it.
+type recorder struct {
+	msgs []*dns.Msg
+}
+
+func (r *recorder) LocalAddr() net.Addr         { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (r *recorder) RemoteAddr() net.Addr        { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353} }
+func (r *recorder) WriteMsg(m *dns.Msg) error   { r.msgs = append(r.msgs, m); return nil }
+func (r *recorder) Write(b []byte) (int, error) { return len(b), nil }
+func (r *recorder) Close() error                { return nil }
+func (r *recorder) TsigStatus() error           { return nil }
+func (r *recorder) TsigTimersOnly(bool)         {}
+func (r *recorder) Hijack()                     {}
+
+// ask sends req through h over udp and returns the answer it writes.
+func ask(h *GODNSHandler, req *dns.Msg) *dns.Msg {
+	w := &recorder{}
+	h.do("udp", w, req)
+	if len(w.msgs) != 1 {
+		return nil
+	}
+	return w.msgs[0]
+}
+
+// newTestHandler returns a handler with a memory cache which resolves
+// through the given upstream nameservers.
+func newTestHandler(t *testing.T, upstreams ...string) *GODNSHandler {
+	saved := conf
+	t.Cleanup(func() { conf = saved })
+	conf = Conf{
+		ResolvConfig: ResolvConf{Timeout: 1, Interval: 200},
+		Cache:        CacheConf{Expire: 600},
+	}
+
+	h := NewHandler()
+	rt := h.resolver.routes.Load()
+	for _, addr := range upstreams {
+		host, port, _ := net.SplitHostPort(addr)
+		u, err := h.resolver.upstreams.get(host + "#" + port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt.servers = append(rt.servers, u)
+	}
+	return h
+}
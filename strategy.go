@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream selection strategies. Lookups ask the upstreams of a group one
+// after the other, interval milliseconds apart, in the order the strategy
+// picks; race asks them all at once.
+const (
+	strategyOrdered    = "ordered"
+	strategyRoundRobin = "round-robin"
+	strategyRandom     = "random"
+	strategyFastest    = "fastest"
+	strategyRace       = "race"
+)
+
+// rttWeight is the weight of a new sample in the RTT moving average.
+const rttWeight = 0.3
+
+func validStrategy(s string) bool {
+	switch s {
+	case "", strategyOrdered, strategyRoundRobin, strategyRandom, strategyFastest, strategyRace:
+		return true
+	}
+	return false
+}
+
+// strategyFor returns the strategy for qname: that of its longest suffix in
+// the strategies setting, the default one otherwise.
+func (r *Resolver) strategyFor(qname string) string {
+	name := strings.TrimSuffix(strings.ToLower(qname), ".")
+	for name != "" {
+		if s, ok := r.config.Strategies[name]; ok {
+			return s
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	if r.config.Strategy == "" {
+		return strategyOrdered
+	}
+	return r.config.Strategy
+}
+
+// order returns the upstreams of group in the order strategy asks them.
+// us is not modified.
+func (r *Resolver) order(strategy, group string, us []*Upstream) []*Upstream {
+	if len(us) < 2 {
+		return us
+	}
+
+	ordered := append([]*Upstream(nil), us...)
+	switch strategy {
+	case strategyRoundRobin:
+		v, _ := r.rounds.LoadOrStore(group, new(atomic.Uint64))
+		// The modulo comes first, int may be 32 bits wide.
+		n := int((v.(*atomic.Uint64).Add(1) - 1) % uint64(len(ordered)))
+		ordered = append(ordered[n:], ordered[:n]...)
+	case strategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	case strategyFastest:
+		// Upstreams without samples yet come first, so that they get some.
+		rtts := make(map[*Upstream]time.Duration, len(ordered))
+		for _, u := range ordered {
+			rtts[u] = u.RTT()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool { return rtts[ordered[i]] < rtts[ordered[j]] })
+	}
+	return ordered
+}
+
+// observeRTT adds a sample to the RTT moving average of the upstream.
+// The caller holds h.mu.
+func (h *upstreamHealth) observeRTT(rtt time.Duration) {
+	if h.rtt == 0 {
+		h.rtt = rtt
+		return
+	}
+	h.rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(h.rtt))
+}
+
+// RTT returns the moving average of the round trip time of u, zero until
+// it has answered once.
+func (u *Upstream) RTT() time.Duration {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	return u.health.rtt
+}
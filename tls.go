@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate and key pair from disk and loads them
+// again once either file changes, so renewed certificates are picked up
+// without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// certCheckInterval bounds how often the certificate files are stat'ed.
+const certCheckInterval = 10 * time.Second
+
+// newCertReloader loads the pair once, so a bad configuration fails early.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, modTime
+	return nil
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return last, err
+		}
+		if fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If reloading fails,
+// the previous certificate is kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now := time.Now(); now.Sub(r.checked) >= certCheckInterval {
+		r.checked = now
+		if modTime, err := r.lastModified(); err == nil && !modTime.Equal(r.modTime) {
+			if err = r.load(); err != nil {
+				logger.Warn("Reload certificate %s failed: %s", r.certFile, err)
+			} else {
+				logger.Info("Reloaded certificate %s", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// TLSConfig returns a server configuration using the reloaded certificate.
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate, MinVersion: tls.VersionTLS12}
+}
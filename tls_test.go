@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the
+// common name cn to dir, and returns the paths of the certificate and key.
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func certCommonName(c *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	Convey("Certificates are reloaded once their files change", t, func() {
+		dir := t.TempDir()
+		certFile, keyFile := writeTestCert(t, dir, "first")
+
+		r, err := newCertReloader(certFile, keyFile)
+		So(err, ShouldBeNil)
+		c, err := r.GetCertificate(nil)
+		So(err, ShouldBeNil)
+		So(certCommonName(c), ShouldEqual, "first")
+
+		writeTestCert(t, dir, "second")
+		later := time.Now().Add(time.Minute)
+		So(os.Chtimes(certFile, later, later), ShouldBeNil)
+
+		c, _ = r.GetCertificate(nil)
+		So(certCommonName(c), ShouldEqual, "first")
+
+		r.checked = time.Time{}
+		c, _ = r.GetCertificate(nil)
+		So(certCommonName(c), ShouldEqual, "second")
+
+		Convey("and kept when the new files are broken", func() {
+			So(os.WriteFile(keyFile, []byte("garbage"), 0o600), ShouldBeNil)
+			later = later.Add(time.Minute)
+			So(os.Chtimes(keyFile, later, later), ShouldBeNil)
+
+			r.checked = time.Time{}
+			c, _ = r.GetCertificate(nil)
+			So(certCommonName(c), ShouldEqual, "second")
+		})
+	})
+
+	Convey("A missing certificate fails early", t, func() {
+		_, err := newCertReloader(filepath.Join(t.TempDir(), "none.crt"), "none.key")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("A tcp-tls server answers with the reloaded certificate", t, func() {
+		certFile, keyFile := writeTestCert(t, t.TempDir(), "godns")
+		r, err := newCertReloader(certFile, keyFile)
+		So(err, ShouldBeNil)
+
+		l, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+		So(err, ShouldBeNil)
+		ds := &dns.Server{Listener: l, Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   remoteIP(w.RemoteAddr()),
+			})
+			w.WriteMsg(m)
+		})}
+		go ds.ActivateAndServe()
+		defer ds.Shutdown()
+
+		pool := x509.NewCertPool()
+		pem, _ := os.ReadFile(certFile)
+		pool.AppendCertsFromPEM(pem)
+		client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool}}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		m, _, err := client.Exchange(req, l.Addr().String())
+		So(err, ShouldBeNil)
+		So(m.Answer, ShouldHaveLength, 1)
+		So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "127.0.0.1")
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream transports.
+const (
+	upstreamPlain = "plain"
+	upstreamTLS   = "tls"
+	upstreamHTTPS = "https"
+)
+
+// upstreamIdleConns bounds the idle DoT connections kept per upstream.
+const upstreamIdleConns = 4
+
+// Upstream is a nameserver godns forwards queries to. Plain upstreams are
+// asked over the transport of the client, tls ones over DNS-over-TLS and
+// https ones over DNS-over-HTTPS. Encrypted connections are reused across
+// queries.
+type Upstream struct {
+	spec  string
+	proto string
+	addr  string
+	url   string
+
+	tlsConfig *tls.Config
+	idle      chan *dns.Conn
+	client    *http.Client
+
+	health upstreamHealth
+}
+
+// ParseUpstream parses the upstream forms of a server-list file:
+//
+//	8.8.8.8
+//	8.8.8.8#5353
+//	tls://1.1.1.1@853#cloudflare-dns.com
+//	https://dns.google/dns-query
+//
+// The port of a tls upstream defaults to 853 and its server name, checked
+// against the certificate, to the host.
+func ParseUpstream(spec string) (*Upstream, error) {
+	u := &Upstream{spec: spec}
+	switch {
+	case strings.HasPrefix(spec, "tls://"):
+		hostPort, serverName := strings.TrimPrefix(spec, "tls://"), ""
+		if i := strings.Index(hostPort, "#"); i >= 0 {
+			hostPort, serverName = hostPort[:i], hostPort[i+1:]
+		}
+		host, port := hostPort, "853"
+		if i := strings.Index(hostPort, "@"); i >= 0 {
+			host, port = hostPort[:i], hostPort[i+1:]
+		}
+		if host == "" || !isPort(port) {
+			return nil, fmt.Errorf("invalid tls upstream %s", spec)
+		}
+		if serverName == "" {
+			serverName = host
+		}
+		u.proto = upstreamTLS
+		u.addr = net.JoinHostPort(host, port)
+		u.tlsConfig = &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+		u.idle = make(chan *dns.Conn, upstreamIdleConns)
+	case strings.HasPrefix(spec, "https://"):
+		p, err := url.Parse(spec)
+		if err != nil || p.Host == "" {
+			return nil, fmt.Errorf("invalid https upstream %s", spec)
+		}
+		u.proto = upstreamHTTPS
+		u.addr = p.Host
+		u.url = spec
+		u.client = &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: upstreamIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}}
+	default:
+		ip, port := spec, "53"
+		if i := strings.Index(spec, "#"); i >= 0 {
+			ip, port = spec[:i], spec[i+1:]
+		}
+		if !isIP(ip) || !isPort(port) {
+			return nil, fmt.Errorf("invalid upstream %s", spec)
+		}
+		u.proto = upstreamPlain
+		u.addr = net.JoinHostPort(ip, port)
+	}
+	return u, nil
+}
+
+func isPort(s string) bool {
+	p, err := strconv.Atoi(s)
+	return err == nil && p > 0 && p < 65536
+}
+
+// String returns the address of plain upstreams and the spec of the
+// encrypted ones.
+func (u *Upstream) String() string {
+	if u.proto == upstreamPlain {
+		return u.addr
+	}
+	return u.spec
+}
+
+// Exchange sends req to the upstream. Plain upstreams are asked with c,
+// encrypted ones with c's timeouts.
+func (u *Upstream) Exchange(c *dns.Client, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	switch u.proto {
+	case upstreamTLS:
+		return u.exchangeTLS(c, req)
+	case upstreamHTTPS:
+		return u.exchangeHTTPS(c, req)
+	default:
+		return c.Exchange(req, u.addr)
+	}
+}
+
+func (u *Upstream) exchangeTLS(c *dns.Client, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	tc := &dns.Client{Net: "tcp-tls", TLSConfig: u.tlsConfig, ReadTimeout: c.ReadTimeout, WriteTimeout: c.WriteTimeout, DialTimeout: c.ReadTimeout}
+
+	// A reused connection may have been closed by the upstream meanwhile,
+	// so a failure on it is retried once on a new one.
+	for {
+		conn, reused, err := u.conn(tc)
+		if err != nil {
+			return nil, 0, err
+		}
+		m, rtt, err := tc.ExchangeWithConn(req, conn)
+		if err != nil {
+			conn.Close()
+			if reused {
+				continue
+			}
+			return nil, rtt, err
+		}
+		u.release(conn)
+		return m, rtt, nil
+	}
+}
+
+// conn returns an idle connection to the upstream, or a new one.
+func (u *Upstream) conn(tc *dns.Client) (*dns.Conn, bool, error) {
+	select {
+	case conn := <-u.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := tc.Dial(u.addr)
+	return conn, false, err
+}
+
+// release keeps conn for the next query, or closes it if enough are idle.
+func (u *Upstream) release(conn *dns.Conn) {
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (u *Upstream) exchangeHTTPS(c *dns.Client, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 asks for ID 0, which makes answers HTTP cacheable.
+	q := req.Copy()
+	q.Id = 0
+	b, err := q.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, 0, err
+	}
+	hreq.Header.Set("Content-Type", dohMediaType)
+	hreq.Header.Set("Accept", dohMediaType)
+
+	client := *u.client
+	client.Timeout = c.ReadTimeout + c.WriteTimeout
+
+	start := time.Now()
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s answered %s", u.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dohMaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+
+	m := new(dns.Msg)
+	if err = m.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	m.Id = req.Id
+	return m, rtt, nil
+}
+
+// upstreams caches the parsed upstreams by spec, so every domain forwarded
+// to the same upstream shares its connections.
+type upstreams struct {
+	mu sync.Mutex
+	m  map[string]*Upstream
+}
+
+func (us *upstreams) get(spec string) (*Upstream, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if u, ok := us.m[spec]; ok {
+		return u, nil
+	}
+	u, err := ParseUpstream(spec)
+	if err != nil {
+		return nil, err
+	}
+	if us.m == nil {
+		us.m = make(map[string]*Upstream)
+	}
+	us.m[spec] = u
+	return u, nil
+}
+
+// retain drops the upstreams whose spec isn't in specs.
+func (us *upstreams) retain(specs map[string]bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for spec := range us.m {
+		if !specs[spec] {
+			delete(us.m, spec)
+		}
+	}
+}
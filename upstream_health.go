@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Health check defaults, see ResolvConf.MaxFails and FailTimeout.
+const (
+	defaultMaxFails    = 3
+	defaultFailTimeout = 30 * time.Second
+)
+
+// upstreamHealth is the circuit breaker of an upstream. After maxFails
+// consecutive failures the upstream is down and skipped by lookups. Once
+// failTimeout has passed, a probe query is sent; its success brings the
+// upstream back, its failure keeps it down for another failTimeout.
+type upstreamHealth struct {
+	mu          sync.Mutex
+	failures    int
+	down        bool
+	retryAt     time.Time
+	probing     bool
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastErr     string
+	queries     uint64
+	errors      uint64
+	rtt         time.Duration
+}
+
+// UpstreamStatus is the health of an upstream as shown to operators.
+type UpstreamStatus struct {
+	Upstream    string     `json:"upstream"`
+	State       string     `json:"state"`
+	Failures    int        `json:"failures"`
+	Queries     uint64     `json:"queries"`
+	Errors      uint64     `json:"errors"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	RTT         float64    `json:"rtt_ms"`
+}
+
+// record updates the health of u with the outcome of a query which took
+// rtt. Failures take the timeout as their rtt, so that an upstream which
+// doesn't answer isn't the fastest.
+func (u *Upstream) record(rtt time.Duration, err error, maxFails int, failTimeout time.Duration) {
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.queries++
+	h.observeRTT(rtt)
+	if err == nil {
+		if h.down {
+			logger.Notice("Upstream %s is up again", u)
+		}
+		h.failures, h.down, h.lastSuccess = 0, false, now
+		return
+	}
+
+	h.errors++
+	h.failures++
+	h.lastFailure, h.lastErr = now, err.Error()
+	if maxFails <= 0 || h.failures < maxFails {
+		return
+	}
+	if !h.down {
+		logger.Warn("Upstream %s is down after %d failures: %s", u, h.failures, err)
+	}
+	h.down, h.retryAt = true, now.Add(failTimeout)
+}
+
+// usable tells whether lookups may use u, and whether it is time to probe
+// a down upstream. Only one probe is in flight at a time.
+func (u *Upstream) usable(now time.Time) (ok, probe bool) {
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.down {
+		return true, false
+	}
+	if h.probing || now.Before(h.retryAt) {
+		return false, false
+	}
+	h.probing = true
+	return false, true
+}
+
+// probe asks u for the root NS records and records the outcome.
+func (u *Upstream) probe(c *dns.Client, maxFails int, failTimeout time.Duration) {
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	m, rtt, err := u.Exchange(c, req)
+	err = exchangeFailure(m, err)
+	if err != nil {
+		rtt = failureRTT(c)
+	}
+
+	u.record(rtt, err, maxFails, failTimeout)
+	u.health.mu.Lock()
+	u.health.probing = false
+	u.health.mu.Unlock()
+}
+
+// errServerFailure is the failure of an upstream answering SERVFAIL.
+var errServerFailure = errors.New("SERVFAIL")
+
+// exchangeFailure returns the failure of an exchange with an upstream as
+// its health sees it: an error, or a SERVFAIL answer.
+func exchangeFailure(m *dns.Msg, err error) error {
+	if err == nil && m != nil && m.Rcode == dns.RcodeServerFailure {
+		return errServerFailure
+	}
+	return err
+}
+
+// failureRTT is the rtt of a query to c which failed: the timeout.
+func failureRTT(c *dns.Client) time.Duration {
+	if c.ReadTimeout > 0 {
+		return c.ReadTimeout
+	}
+	return 2 * time.Second // the default of dns.Client
+}
+
+// Status returns the health of u.
+func (u *Upstream) Status() UpstreamStatus {
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := UpstreamStatus{
+		Upstream:  u.String(),
+		State:     "up",
+		Failures:  h.failures,
+		Queries:   h.queries,
+		Errors:    h.errors,
+		LastError: h.lastErr,
+		RTT:       float64(h.rtt) / float64(time.Millisecond),
+	}
+	switch {
+	case h.probing:
+		s.State = "probing"
+	case h.down:
+		s.State = "down"
+	}
+	if !h.lastSuccess.IsZero() {
+		t := h.lastSuccess
+		s.LastSuccess = &t
+	}
+	if !h.lastFailure.IsZero() {
+		t := h.lastFailure
+		s.LastFailure = &t
+	}
+	return s
+}
+
+// healthy returns the usable upstreams of us, probing the down ones which
+// are due. If none is usable, all of them are returned: a lookup which may
+// still succeed beats certain failure.
+func (r *Resolver) healthy(us []*Upstream) []*Upstream {
+	maxFails, failTimeout := r.healthConf()
+	now := time.Now()
+
+	var ok []*Upstream
+	for _, u := range us {
+		usable, probe := u.usable(now)
+		if usable {
+			ok = append(ok, u)
+		}
+		if probe {
+			c := &dns.Client{ReadTimeout: r.Timeout(), WriteTimeout: r.Timeout()}
+			go u.probe(c, maxFails, failTimeout)
+		}
+	}
+	if len(ok) == 0 {
+		return us
+	}
+	return ok
+}
+
+func (r *Resolver) healthConf() (int, time.Duration) {
+	maxFails, failTimeout := r.config.MaxFails, time.Duration(r.config.FailTimeout)*time.Second
+	if maxFails == 0 {
+		maxFails = defaultMaxFails
+	}
+	if failTimeout <= 0 {
+		failTimeout = defaultFailTimeout
+	}
+	return maxFails, failTimeout
+}
+
+// UpstreamStatus returns the health of every upstream, sorted by name.
+func (r *Resolver) UpstreamStatus() []UpstreamStatus {
+	r.upstreams.mu.Lock()
+	us := make([]*Upstream, 0, len(r.upstreams.m))
+	for _, u := range r.upstreams.m {
+		us = append(us, u)
+	}
+	r.upstreams.mu.Unlock()
+
+	statuses := make([]UpstreamStatus, 0, len(us))
+	for _, u := range us {
+		statuses = append(statuses, u.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Upstream < statuses[j].Upstream })
+	return statuses
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return c, err
+}
+
+func TestParseUpstream(t *testing.T) {
+	Convey("Upstreams parse from server-list entries", t, func() {
+		for spec, want := range map[string][3]string{
+			"8.8.8.8":                              {upstreamPlain, "8.8.8.8:53", ""},
+			"8.8.8.8#5353":                         {upstreamPlain, "8.8.8.8:5353", ""},
+			"2001:4860:4860::8888":                 {upstreamPlain, "[2001:4860:4860::8888]:53", ""},
+			"tls://1.1.1.1@853#cloudflare-dns.com": {upstreamTLS, "1.1.1.1:853", "cloudflare-dns.com"},
+			"tls://1.1.1.1":                        {upstreamTLS, "1.1.1.1:853", "1.1.1.1"},
+			"tls://dns.google@8853":                {upstreamTLS, "dns.google:8853", "dns.google"},
+			"https://dns.google/dns-query":         {upstreamHTTPS, "dns.google", ""},
+		} {
+			u, err := ParseUpstream(spec)
+			So(err, ShouldBeNil)
+			So(u.proto, ShouldEqual, want[0])
+			So(u.addr, ShouldEqual, want[1])
+			if u.tlsConfig != nil {
+				So(u.tlsConfig.ServerName, ShouldEqual, want[2])
+			}
+		}
+
+		for _, spec := range []string{"", "dns.google", "8.8.8.8#port", "tls://", "tls://1.1.1.1@0", "https://"} {
+			_, err := ParseUpstream(spec)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Server-list files take plain and encrypted upstreams", t, func() {
+		path := filepath.Join(t.TempDir(), "servers.conf")
+		So(os.WriteFile(path, []byte(`server=8.8.8.8#53
+server=tls://1.1.1.1#cloudflare-dns.com
+server=/google.com/https://dns.google/dns-query
+server=/baidu.com/114.114.114.114
+server=/bad.com/not-an-upstream
+`), 0o600), ShouldBeNil)
+
+		r := NewResolver(ResolvConf{ServerListFile: path})
+		servers := r.routes.Load().servers
+		So(servers, ShouldHaveLength, 2)
+		So(servers[1].String(), ShouldEqual, "tls://1.1.1.1#cloudflare-dns.com")
+
+		ns := r.Nameservers("www.google.com.")
+		So(ns, ShouldHaveLength, 1)
+		So(ns[0].proto, ShouldEqual, upstreamHTTPS)
+		So(r.Nameservers("www.baidu.com.")[0].String(), ShouldEqual, "114.114.114.114:53")
+		So(r.Nameservers("www.bad.com."), ShouldHaveLength, 2)
+	})
+}
+
+func TestEncryptedUpstreams(t *testing.T) {
+	client := &dns.Client{ReadTimeout: time.Second, WriteTimeout: time.Second}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	Convey("DoT upstreams reuse their connection", t, func() {
+		certFile, keyFile := writeTestCert(t, t.TempDir(), "godns")
+		certs, err := newCertReloader(certFile, keyFile)
+		So(err, ShouldBeNil)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		counting := &countingListener{Listener: ln}
+		upstream := &upstreamStandin{A: net.ParseIP("192.0.2.1"), TTL: 60}
+		ds := &dns.Server{
+			Listener:    tls.NewListener(counting, certs.TLSConfig()),
+			Net:         "tcp-tls",
+			Handler:     upstream,
+			IdleTimeout: func() time.Duration { return 200 * time.Millisecond },
+		}
+		go ds.ActivateAndServe()
+		defer ds.Shutdown()
+
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		u, err := ParseUpstream("tls://127.0.0.1@" + port + "#127.0.0.1")
+		So(err, ShouldBeNil)
+		pool := x509.NewCertPool()
+		pem, _ := os.ReadFile(certFile)
+		pool.AppendCertsFromPEM(pem)
+		u.tlsConfig.RootCAs = pool
+
+		for i := 0; i < 3; i++ {
+			m, _, err := u.Exchange(client, req)
+			So(err, ShouldBeNil)
+			So(m.Answer, ShouldHaveLength, 1)
+		}
+		So(upstream.queries.Load(), ShouldEqual, 3)
+		So(counting.accepted.Load(), ShouldEqual, 1)
+
+		Convey("and redial once the upstream closed it", func() {
+			time.Sleep(400 * time.Millisecond)
+			m, _, err := u.Exchange(client, req)
+			So(err, ShouldBeNil)
+			So(m.Answer, ShouldHaveLength, 1)
+			So(counting.accepted.Load(), ShouldEqual, 2)
+		})
+	})
+
+	Convey("DoH upstreams post wire format messages", t, func() {
+		upstream := newUpstreamStandin(t, "192.0.2.1", 60)
+		srv := httptest.NewTLSServer(&DoHServer{path: "/dns-query", handler: dns.HandlerFunc(newTestHandler(t, upstream.addr).DoHTTPS)})
+		defer srv.Close()
+
+		u, err := ParseUpstream(srv.URL + "/dns-query")
+		So(err, ShouldBeNil)
+		u.client = srv.Client()
+
+		req.Id = 4242
+		m, _, err := u.Exchange(client, req)
+		So(err, ShouldBeNil)
+		So(m.Id, ShouldEqual, 4242)
+		So(m.Answer, ShouldHaveLength, 1)
+		So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "192.0.2.1")
+	})
+}
+
+func TestUpstreamHealth(t *testing.T) {
+	Convey("Upstreams go down after consecutive failures and come back after a probe", t, func() {
+		u, err := ParseUpstream("192.0.2.1")
+		So(err, ShouldBeNil)
+		failed := errors.New("i/o timeout")
+
+		u.record(0, failed, 3, time.Minute)
+		u.record(0, nil, 3, time.Minute)
+		u.record(0, failed, 3, time.Minute)
+		u.record(0, failed, 3, time.Minute)
+		ok, _ := u.usable(time.Now())
+		So(ok, ShouldBeTrue)
+
+		u.record(0, failed, 3, time.Minute)
+		So(u.Status().State, ShouldEqual, "down")
+		So(u.Status().Failures, ShouldEqual, 3)
+		So(u.Status().LastError, ShouldEqual, "i/o timeout")
+		ok, probe := u.usable(time.Now())
+		So(ok, ShouldBeFalse)
+		So(probe, ShouldBeFalse)
+
+		ok, probe = u.usable(time.Now().Add(2 * time.Minute))
+		So(ok, ShouldBeFalse)
+		So(probe, ShouldBeTrue)
+		So(u.Status().State, ShouldEqual, "probing")
+		_, probe = u.usable(time.Now().Add(2 * time.Minute))
+		So(probe, ShouldBeFalse)
+
+		u.record(0, nil, 3, time.Minute)
+		u.health.probing = false
+		So(u.Status().State, ShouldEqual, "up")
+		So(u.Status().Failures, ShouldEqual, 0)
+		So(u.Status().Queries, ShouldEqual, 6)
+		So(u.Status().Errors, ShouldEqual, 4)
+	})
+
+	Convey("Lookups skip a dead upstream and probe it until it recovers", t, func() {
+		dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		deadAddr := dead.LocalAddr().String()
+		dead.Close()
+		live := newUpstreamStandin(t, "192.0.2.1", 60)
+
+		h := newTestHandler(t, deadAddr, live.addr)
+		h.resolver.config.MaxFails = 2
+		conf.ResolvConfig.Interval = 500
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		for i := 0; i < 2; i++ {
+			_, err = h.resolver.Lookup("udp", req)
+			So(err, ShouldBeNil)
+		}
+
+		ns := h.resolver.Nameservers("www.example.com.")
+		So(ns, ShouldHaveLength, 1)
+		So(ns[0].String(), ShouldEqual, live.addr)
+
+		start := time.Now()
+		_, err = h.resolver.Lookup("udp", req)
+		So(err, ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, 400*time.Millisecond)
+
+		statuses := h.resolver.UpstreamStatus()
+		So(statuses, ShouldHaveLength, 2)
+		for _, s := range statuses {
+			if s.Upstream == deadAddr {
+				So(s.State, ShouldEqual, "down")
+			} else {
+				So(s.State, ShouldEqual, "up")
+			}
+		}
+
+		// The dead upstream comes back and the probe notices.
+		pc, err := net.ListenPacket("udp", deadAddr)
+		So(err, ShouldBeNil)
+		revived := &dns.Server{PacketConn: pc, Handler: live}
+		go revived.ActivateAndServe()
+		defer revived.Shutdown()
+
+		down := h.resolver.routes.Load().servers[0]
+		down.health.mu.Lock()
+		down.health.retryAt = time.Now()
+		down.health.mu.Unlock()
+		So(h.resolver.Nameservers("www.example.com."), ShouldHaveLength, 1)
+		for i := 0; i < 100 && down.Status().State != "up"; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(down.Status().State, ShouldEqual, "up")
+		So(h.resolver.Nameservers("www.example.com."), ShouldHaveLength, 2)
+	})
+
+	Convey("An upstream answering SERVFAIL goes down like one which doesn't answer", t, func() {
+		failing := newUpstreamStandin(t, "192.0.2.1", 60)
+		failing.rcode.Store(dns.RcodeServerFailure)
+		live := newUpstreamStandin(t, "192.0.2.2", 60)
+
+		h := newTestHandler(t, failing.addr, live.addr)
+		h.resolver.config.MaxFails = 2
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		for i := 0; i < 2; i++ {
+			m, err := h.resolver.Lookup("udp", req)
+			So(err, ShouldBeNil)
+			So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "192.0.2.2")
+		}
+
+		s := h.resolver.routes.Load().servers[0].Status()
+		So(s.State, ShouldEqual, "down")
+		So(s.Errors, ShouldEqual, 2)
+		So(s.LastError, ShouldEqual, "SERVFAIL")
+		So(s.RTT, ShouldBeGreaterThanOrEqualTo, 1000)
+		So(h.resolver.Nameservers("www.example.com."), ShouldHaveLength, 1)
+	})
+}
+
+func TestUpstreamStrategies(t *testing.T) {
+	Convey("Upstreams are ordered by the strategy of the query name", t, func() {
+		var us []*Upstream
+		for _, spec := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+			u, err := ParseUpstream(spec)
+			So(err, ShouldBeNil)
+			us = append(us, u)
+		}
+		r := &Resolver{config: &ResolvConf{
+			Strategy:   strategyRoundRobin,
+			Strategies: map[string]string{"example.com": strategyFastest, "www.example.com": strategyRace},
+		}}
+
+		So(r.strategyFor("a.example.org."), ShouldEqual, strategyRoundRobin)
+		So(r.strategyFor("a.example.com."), ShouldEqual, strategyFastest)
+		So(r.strategyFor("WWW.example.com."), ShouldEqual, strategyRace)
+		So(r.strategyFor("a.www.example.com."), ShouldEqual, strategyRace)
+
+		Convey("round-robin rotates the first upstream of each group", func() {
+			So(r.order(strategyRoundRobin, ".", us)[0], ShouldEqual, us[0])
+			So(r.order(strategyRoundRobin, ".", us)[0], ShouldEqual, us[1])
+			So(r.order(strategyRoundRobin, "other", us)[0], ShouldEqual, us[0])
+			So(r.order(strategyRoundRobin, ".", us), ShouldResemble, []*Upstream{us[2], us[0], us[1]})
+
+			// Past 2^31 lookups the position doesn't turn negative.
+			v, _ := r.rounds.Load(".")
+			v.(*atomic.Uint64).Store(1<<63 + 1)
+			So(r.order(strategyRoundRobin, ".", us)[0], ShouldEqual, us[(1<<63+1)%3])
+		})
+
+		Convey("fastest asks the lowest moving average RTT first", func() {
+			us[0].record(90*time.Millisecond, nil, 3, time.Minute)
+			us[1].record(10*time.Millisecond, nil, 3, time.Minute)
+			us[1].record(110*time.Millisecond, nil, 3, time.Minute)
+			So(us[1].RTT(), ShouldEqual, 40*time.Millisecond)
+			So(r.order(strategyFastest, ".", us), ShouldResemble, []*Upstream{us[2], us[1], us[0]})
+			So(us[1].Status().RTT, ShouldEqual, 40)
+		})
+
+		Convey("fastest asks an upstream which never answers last", func() {
+			us[0].record(20*time.Millisecond, nil, -1, time.Minute)
+			us[1].record(30*time.Millisecond, nil, -1, time.Minute)
+			us[2].record(5*time.Second, errors.New("i/o timeout"), -1, time.Minute)
+			So(r.order(strategyFastest, ".", us), ShouldResemble, []*Upstream{us[0], us[1], us[2]})
+		})
+
+		Convey("random keeps every upstream", func() {
+			So(r.order(strategyRandom, ".", us), ShouldHaveLength, 3)
+		})
+	})
+
+	Convey("race asks every upstream at once", t, func() {
+		slow := newUpstreamStandin(t, "192.0.2.1", 60)
+		slow.delay.Store(int64(time.Second))
+		fast := newUpstreamStandin(t, "192.0.2.2", 60)
+
+		h := newTestHandler(t, slow.addr, fast.addr)
+		conf.ResolvConfig.Interval = 500
+		h.resolver.config.Strategies = map[string]string{"example.com": strategyRace}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		start := time.Now()
+		m, err := h.resolver.Lookup("udp", req)
+		So(err, ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, 400*time.Millisecond)
+		So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "192.0.2.2")
+		for i := 0; i < 50 && slow.queries.Load() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(slow.queries.Load(), ShouldEqual, 1)
+	})
+}
+
+func TestDomainUpstreams(t *testing.T) {
+	Convey("Every server line of a domain adds an upstream to fail over to", t, func() {
+		dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		deadAddr := dead.LocalAddr().String()
+		dead.Close()
+		live := newUpstreamStandin(t, "10.0.0.1", 60)
+
+		h := newTestHandler(t)
+		conf.ResolvConfig.Interval = 100
+		file := filepath.Join(t.TempDir(), "servers.conf")
+		hostport := func(addr string) string { return strings.Replace(addr, ":", "#", 1) }
+		So(os.WriteFile(file, []byte("server=/corp.example/"+hostport(deadAddr)+"\n"+
+			"server=/corp.example/"+hostport(live.addr)+"\n"), 0o644), ShouldBeNil)
+		h.resolver.config.ServerListFile = file
+		So(h.resolver.Reload(), ShouldBeNil)
+
+		ns := h.resolver.Nameservers("git.corp.example.")
+		So(ns, ShouldHaveLength, 2)
+		So(ns[0].String(), ShouldEqual, deadAddr)
+		So(ns[1].String(), ShouldEqual, live.addr)
+
+		req := new(dns.Msg)
+		req.SetQuestion("git.corp.example.", dns.TypeA)
+		m, err := h.resolver.Lookup("udp", req)
+		So(err, ShouldBeNil)
+		So(m.Answer[0].(*dns.A).A.String(), ShouldEqual, "10.0.0.1")
+	})
+}
@@ -9,10 +9,28 @@ func isDomain(domain string) bool {
 	if isIP(domain) {
 		return false
 	}
-	match, _ := regexp.MatchString(`^([a-zA-Z0-9\*]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,6}$`, domain)
+	match, _ := regexp.MatchString(`^([a-zA-Z0-9\*]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,63}$`, domain)
 	return match
 }
 
+// isDomainSuffix tells whether s may be the domain of a server-list
+// directive: a domain, or a single label like lan.
+func isDomainSuffix(s string) bool {
+	if isDomain(s) {
+		return true
+	}
+	match, _ := regexp.MatchString(`^[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?$`, s)
+	return match && !isIP(s)
+}
+
 func isIP(ip string) bool {
 	return (net.ParseIP(ip) != nil)
 }
+
+// minPositive returns the smaller of a and b, ignoring zero values.
+func minPositive(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -27,5 +27,9 @@ func TestHostDomainAndIP(t *testing.T) {
 			So(isDomain("123.test"), ShouldEqual, true)
 			So(isIP("123.test"), ShouldEqual, false)
 		})
+
+		Convey("`corp.example` should be domain", func() {
+			So(isDomain("corp.example"), ShouldEqual, true)
+		})
 	})
 }